@@ -0,0 +1,215 @@
+package main
+
+/*
+	ACL
+
+	Channels are open to everyone unless an access rule in the
+	[ACL] section of the config covers them. Each rule is
+
+		name = <channel pattern> <actions> <who>
+
+	actions is a comma separated list of subscribe, publish and
+	presence, or * for all of them. who is a comma separated list
+	of identities, role:<role> for connections whose auth token
+	has the role, or * for any connection with an identity:
+
+		private = private.*   *                  alice,bob,role:staff
+		admin   = admin.#     subscribe,publish  role:admin
+
+	An action on a channel is allowed if no rule for that action
+	overlaps the channel, or if any rule that does lets the client
+	in. A wildcard subscription overlapping a protected channel
+	needs access to it, since it would receive its messages.
+
+	Broadcast channels ([Messaging] broadcast-channels) are read-only
+	for clients. Only the server side, through /api/publish, and the
+	broadcast-publishers (in the same form as who above) can publish
+	to them.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrBroadcastChannel = errors.New("channel is read-only, only the api and broadcast publishers can publish to it")
+)
+
+const (
+	ACL_SUBSCRIBE = "subscribe"
+	ACL_PUBLISH   = "publish"
+	ACL_PRESENCE  = "presence"
+
+	ACL_ROLE_PREFIX = "role:"
+)
+
+type ACLRule struct {
+	Name    string
+	Pattern string
+	Actions []string
+	Allow   []string
+}
+
+func (r ACLRule) String() string {
+	return fmt.Sprintf("%v = %v %v %v", r.Name, r.Pattern, strings.Join(r.Actions, ","), strings.Join(r.Allow, ","))
+}
+
+// Parses the value of an option in the [ACL] section
+func parseACLRule(name, value string) (ACLRule, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 3 {
+		return ACLRule{}, fmt.Errorf("ACL rule %v: expected a channel pattern, actions and who is allowed", name)
+	}
+
+	rule := ACLRule{
+		Name:    name,
+		Pattern: fields[0],
+		Actions: strings.Split(fields[1], ","),
+		Allow:   strings.Split(fields[2], ","),
+	}
+
+	if err := validatePattern(rule.Pattern); err != nil {
+		return ACLRule{}, fmt.Errorf("ACL rule %v: %v", name, err)
+	}
+	for _, action := range rule.Actions {
+		switch action {
+		case ACL_SUBSCRIBE, ACL_PUBLISH, ACL_PRESENCE, "*":
+		default:
+			return ACLRule{}, fmt.Errorf("ACL rule %v: unknown action %q", name, action)
+		}
+	}
+	for _, who := range rule.Allow {
+		if who == "" || who == ACL_ROLE_PREFIX {
+			return ACLRule{}, fmt.Errorf("ACL rule %v: empty identity or role", name)
+		}
+	}
+	return rule, nil
+}
+
+func (r ACLRule) hasAction(action string) bool {
+	for _, a := range r.Actions {
+		if a == action || a == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the rule lets the identity, or one of
+// the roles, in
+func (r ACLRule) admits(identity string, roles []string) bool {
+	for _, who := range r.Allow {
+		switch {
+		case strings.HasPrefix(who, ACL_ROLE_PREFIX):
+			for _, role := range roles {
+				if role == who[len(ACL_ROLE_PREFIX):] {
+					return true
+				}
+			}
+		case who == "*":
+			if identity != "" {
+				return true
+			}
+		case who == identity:
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the rules allow the action on the channel,
+// or pattern, by a client with the identity and roles
+func aclAllows(rules []ACLRule, identity string, roles []string, action, channel string) bool {
+	protected := false
+	for _, rule := range rules {
+		if !rule.hasAction(action) || !patternsOverlap(rule.Pattern, channel) {
+			continue
+		}
+		if rule.admits(identity, roles) {
+			return true
+		}
+		protected = true
+	}
+	return !protected
+}
+
+// An action on a channel that the ACL rules deny
+type ACLError struct {
+	Action  string
+	Channel string
+}
+
+func (e *ACLError) Error() string {
+	return fmt.Sprintf("%v on channel %v is not allowed", e.Action, e.Channel)
+}
+
+// Builds the onError reply telling the client which
+// action was denied
+func (e *ACLError) Reply() *message {
+	return newActionError(e.Action, e.Channel, e)
+}
+
+// Builds an onError reply for an action on a channel
+func newActionError(action, channel string, err error) *message {
+	reply := NewCommand()
+	reply.Channel = channel
+	reply.Error = err.Error()
+	reply.Success = false
+	reply.Data["command"] = "onError"
+	reply.Data["action"] = action
+	return reply
+}
+
+// Checks the ACL rules for an action on a channel by a
+// connection. Returns an *ACLError if it is denied.
+func (s *ServerHandler) checkACL(c Conn, identity, action, channel string) error {
+	rules := currentConfig().ACL_RULES
+	if len(rules) == 0 {
+		return nil
+	}
+
+	if aclAllows(rules, identity, s.clientRoles(c), action, channel) {
+		return nil
+	}
+	return &ACLError{Action: action, Channel: channel}
+}
+
+// Returns the roles from the auth token of a connection
+func (s *ServerHandler) clientRoles(c Conn) []string {
+	s.clientsLock.RLock()
+	defer s.clientsLock.RUnlock()
+
+	if claims := s.auth[c.String()]; claims != nil {
+		return claims.Roles
+	}
+	return nil
+}
+
+// Returns true if the channel is a broadcast channel
+func isBroadcast(conf *Config, channel string) bool {
+	for _, pattern := range conf.BROADCAST_CHANNELS {
+		if patternCovers(pattern, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks a client publish to a channel. Broadcast channels
+// only take publishes from the broadcast publishers. A direct
+// message naming a broadcast channel is checked too, since it
+// would be shown on that channel.
+func (s *ServerHandler) checkBroadcast(c Conn, msg *message) error {
+	conf := currentConfig()
+	if msg.Channel == "" || !isBroadcast(conf, msg.Channel) {
+		return nil
+	}
+
+	publishers := ACLRule{Allow: conf.BROADCAST_PUBLISHERS}
+	if publishers.admits(msg.Identity, s.clientRoles(c)) {
+		return nil
+	}
+	return ErrBroadcastChannel
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestACLAllows(t *testing.T) {
+	rules := []ACLRule{}
+	for name, value := range map[string]string{
+		"admin":    "admin.#   subscribe,publish  role:admin",
+		"announce": "announce  publish            role:editor",
+		"private":  "private.* *                  alice,bob,role:staff",
+		"users":    "users.*   presence           *",
+	} {
+		rule, err := parseACLRule(name, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, rule)
+	}
+
+	tests := []struct {
+		identity string
+		roles    []string
+		action   string
+		channel  string
+		allowed  bool
+	}{
+		{"", nil, ACL_SUBSCRIBE, "news", true},
+		{"", nil, ACL_SUBSCRIBE, "private.alice", false},
+		{"carol", nil, ACL_PUBLISH, "private.alice", false},
+		{"alice", nil, ACL_PUBLISH, "private.alice", true},
+		{"carol", []string{"staff"}, ACL_PRESENCE, "private.alice", true},
+		{"carol", nil, ACL_SUBSCRIBE, "#", false},
+		{"carol", nil, ACL_SUBSCRIBE, "news.*", true},
+		{"carol", nil, ACL_SUBSCRIBE, "admin.logs", false},
+		{"carol", []string{"admin"}, ACL_SUBSCRIBE, "admin.logs", true},
+		{"carol", nil, ACL_PRESENCE, "admin.logs", true},
+		{"carol", nil, ACL_SUBSCRIBE, "announce", true},
+		{"carol", nil, ACL_PUBLISH, "announce", false},
+		{"carol", []string{"editor"}, ACL_PUBLISH, "announce", true},
+		{"", nil, ACL_PRESENCE, "users.online", false},
+		{"carol", nil, ACL_PRESENCE, "users.online", true},
+	}
+
+	for _, test := range tests {
+		if allowed := aclAllows(rules, test.identity, test.roles, test.action, test.channel); allowed != test.allowed {
+			t.Errorf("Expected %q %v %v on %q to be allowed=%v", test.identity, test.roles, test.action, test.channel, test.allowed)
+		}
+	}
+
+	for _, bad := range []string{
+		"private.*",
+		"private.* read alice",
+		"private.#.x * alice",
+		"private.* * alice,,bob",
+	} {
+		if _, err := parseACLRule("bad", bad); err == nil {
+			t.Errorf("Expected an error parsing ACL rule %q", bad)
+		}
+	}
+}
+
+// TestACLConfig
+// Reads ACL rules from a config file
+func TestACLConfig(t *testing.T) {
+
+	defer func(root string) { ROOT = root }(ROOT)
+	ROOT = t.TempDir()
+
+	writeTestFile(t, ROOT, CONF_NAME, `
+[ACL]
+private = private.* subscribe,presence alice,role:staff
+admin = admin.# * role:admin
+`)
+	c, err := getConf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := defaultConfig()
+	if err = readConfig(c, &conf); err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.ACL_RULES) != 2 || conf.ACL_RULES[1].String() != "private = private.* subscribe,presence alice,role:staff" {
+		t.Fatalf("Expected the admin and private rules but got %v", conf.ACL_RULES)
+	}
+
+	writeTestFile(t, ROOT, CONF_NAME, "[ACL]\nprivate = private.* read alice\n")
+	c, _ = getConf()
+	if err = readConfig(c, &conf); err == nil {
+		t.Fatal("Expected an error for an invalid ACL rule")
+	}
+
+	writeTestFile(t, ROOT, CONF_NAME, "[Messaging]\nbroadcast-channels = announce, news.#\nbroadcast-publishers = alice, role:editor\n")
+	c, _ = getConf()
+	conf = defaultConfig()
+	if err = readConfig(c, &conf); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(conf.BROADCAST_CHANNELS, conf.BROADCAST_PUBLISHERS) != "[announce news.#] [alice role:editor]" {
+		t.Fatalf("Expected the broadcast channels and publishers but got %v %v", conf.BROADCAST_CHANNELS, conf.BROADCAST_PUBLISHERS)
+	}
+
+	writeTestFile(t, ROOT, CONF_NAME, "[Messaging]\nbroadcast-channels = news.#.eu\n")
+	c, _ = getConf()
+	if err = readConfig(c, &conf); err == nil {
+		t.Fatal("Expected an error for an invalid broadcast channel")
+	}
+}
+
+// TestACLServer
+// Checks the server denies subscribes, publishes and presence
+// the ACL rules don't allow, with an onError naming the action
+func TestACLServer(t *testing.T) {
+
+	rule, _ := parseACLRule("private", "private.* * alice,role:staff")
+	setTestConfig(t, func(conf *Config) {
+		conf.ACL_RULES = []ACLRule{rule}
+		conf.AUTH_SECRET = "test secret"
+		conf.OUTBOUND_QUEUE = 0
+	})
+
+	server := NewServerHandler(nil)
+	defer server.Shutdown()
+
+	send := func(c Conn, format string, args ...interface{}) {
+		server.OnRawMessage(c, []byte(fmt.Sprintf(format, args...)))
+	}
+	isError := func(msg *message) bool { return msg.Error != "" }
+	expectDenied := func(c *recordConn, action string) {
+		msg := c.until(t, isError)
+		if msg.Data["command"] != "onError" || msg.Data["action"] != action || msg.Channel != "private.alice" {
+			t.Fatalf("%v: Expected an onError for %v on private.alice but got %+v", c, action, msg)
+		}
+	}
+
+	carol := newRecordConn("carol")
+	send(carol, `{"type":"command","data":{"command":"init","token":%q}}`,
+		makeJWT(t, "HS256", map[string]interface{}{"sub": "carol"}, hs256("test secret")))
+	defer server.OnDisconnect(carol)
+
+	send(carol, `{"type":"command","channel":"private.alice","data":{"command":"subscribe"}}`)
+	expectDenied(carol, ACL_SUBSCRIBE)
+
+	send(carol, `{"type":"message","channel":"private.alice","data":{"msg":"hi"}}`)
+	expectDenied(carol, ACL_PUBLISH)
+
+	send(carol, `{"type":"command","channel":"private.alice","data":{"command":"presence"}}`)
+	expectDenied(carol, ACL_PRESENCE)
+
+	// a wildcard that takes in the private channels
+	send(carol, `{"type":"command","channel":"*.alice","data":{"command":"subscribe"}}`)
+	if msg := carol.until(t, isError); msg.Data["action"] != ACL_SUBSCRIBE || msg.Channel != "*.alice" {
+		t.Fatalf("Expected the wildcard subscribe to be denied but got %+v", msg)
+	}
+
+	// staff get in by role
+	dave := newRecordConn("dave")
+	send(dave, `{"type":"command","data":{"command":"init","token":%q}}`,
+		makeJWT(t, "HS256", map[string]interface{}{"sub": "dave", "roles": []string{"staff"}}, hs256("test secret")))
+	defer server.OnDisconnect(dave)
+
+	send(dave, `{"type":"command","channel":"private.alice","data":{"command":"subscribe"}}`)
+	if msg := dave.until(t, func(msg *message) bool { return isError(msg) || msg.Data["command"] == "onSubscribe" }); isError(msg) {
+		t.Fatalf("Expected staff to subscribe to private.alice but got %+v", msg)
+	}
+}
+
+// TestBroadcastChannels
+// Checks clients can't publish to a broadcast channel unless
+// they are a broadcast publisher, while the api still can
+func TestBroadcastChannels(t *testing.T) {
+
+	setTestConfig(t, func(conf *Config) {
+		conf.BROADCAST_CHANNELS = []string{"announce", "news.#"}
+		conf.BROADCAST_PUBLISHERS = []string{"role:editor"}
+		conf.AUTH_SECRET = "test secret"
+		conf.OUTBOUND_QUEUE = 0
+	})
+
+	server := NewServerHandler(nil)
+	defer server.Shutdown()
+
+	send := func(c Conn, format string, args ...interface{}) {
+		server.OnRawMessage(c, []byte(fmt.Sprintf(format, args...)))
+	}
+	isError := func(msg *message) bool { return msg.Error != "" }
+	isMessage := func(msg *message) bool { return msg.Type == "message" }
+
+	carol := newRecordConn("carol")
+	send(carol, `{"type":"command","data":{"command":"init","token":%q}}`,
+		makeJWT(t, "HS256", map[string]interface{}{"sub": "carol"}, hs256("test secret")))
+	defer server.OnDisconnect(carol)
+
+	send(carol, `{"type":"command","channel":"news.eu","data":{"command":"subscribe"}}`)
+	if msg := carol.until(t, func(msg *message) bool { return isError(msg) || msg.Data["command"] == "onSubscribe" }); isError(msg) {
+		t.Fatalf("Expected carol to subscribe to a broadcast channel but got %+v", msg)
+	}
+
+	for _, raw := range []string{
+		`{"type":"message","channel":"news.eu","data":{"msg":"hi"}}`,
+		`{"type":"command","channel":"announce","data":{"command":"custom"}}`,
+		`{"type":"message","to":"carol","channel":"announce","data":{"msg":"official"}}`,
+	} {
+		send(carol, "%s", raw)
+		msg := carol.until(t, isError)
+		if msg.Error != ErrBroadcastChannel.Error() || msg.Data["action"] != ACL_PUBLISH {
+			t.Fatalf("Expected %v to be refused but got %+v", raw, msg)
+		}
+	}
+
+	// the api publishes as usual
+	msg := NewMessage()
+	msg.Type = "message"
+	msg.Channel = "news.eu"
+	msg.Data["msg"] = "from the api"
+	if err := server.publishReq(NewDispatchReq(nil, msg, false)); err != nil {
+		t.Fatal(err)
+	}
+	if msg := carol.until(t, isMessage); msg.Data["msg"] != "from the api" {
+		t.Fatalf("Expected the api message but got %+v", msg)
+	}
+
+	// and so do editors
+	erin := newRecordConn("erin")
+	send(erin, `{"type":"command","data":{"command":"init","token":%q}}`,
+		makeJWT(t, "HS256", map[string]interface{}{"sub": "erin", "roles": []string{"editor"}}, hs256("test secret")))
+	defer server.OnDisconnect(erin)
+
+	send(erin, `{"type":"message","channel":"news.eu","data":{"msg":"from erin"}}`)
+	if msg := carol.until(t, isMessage); msg.Data["msg"] != "from erin" {
+		t.Fatalf("Expected the editor's message but got %+v", msg)
+	}
+}
@@ -2,37 +2,95 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
 )
 
+const (
+	// the most messages a batch publish can carry
+	API_BATCH_LIMIT = 1000
+
+	// the largest request Body accepted, in bytes
+	API_MAX_BODY = 16 << 20
+
+	NDJSON_CONTENT_TYPE = "application/x-ndjson"
+)
+
 // The handler function for accepting and publishing messages
 // via a POST request. Request Body must be a valid JSON message
-// structure.
+// structure. The response Body is a JSON object with the id
+// and channel sequence the message was assigned, and if the
+// message asked for an ack, the number of connections it
+// was delivered to.
+// A Body with a JSON array of messages, or with one message per
+// line and an application/x-ndjson Content-Type, is a batch. The
+// Body doesn't need a Content-Length, so it can be streamed. Each
+// message is checked on its own and they are published in order.
+// The response is an array with the result of each message, or
+// its error and status.
+// With API keys configured, the request needs a key that allows
+// the message, instead of a licensed origin.
 func HandlePostAPIPublish(writer http.ResponseWriter, req *http.Request) {
 
+	keys := currentAPIKeys()
+
+	var key *APIKey
+	if keys != nil {
+		key = keys.Lookup(req)
+	}
+
 	if req.Method != "POST" {
 		writer.WriteHeader(http.StatusMethodNotAllowed)
 		return
 
-	} else if !LICENSE.CheckHttpRequest(req) {
+	} else if keys != nil && key == nil {
+		writer.WriteHeader(http.StatusUnauthorized)
+		writer.Write([]byte(fmt.Sprintf("Error: %v\n", ErrAPIKeyRequired)))
+		return
+
+	} else if keys == nil && !currentLicense().CheckHttpRequest(req) {
 		writer.WriteHeader(http.StatusUnauthorized)
 		writer.Write([]byte("Error: Domain name origin is not licensed for this server\n"))
 		return
+	}
 
-	} else if req.ContentLength == -1 {
-		writer.WriteHeader(http.StatusLengthRequired)
+	body := http.MaxBytesReader(writer, req.Body, API_MAX_BODY)
+
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType == NDJSON_CONTENT_TYPE {
+		items, err := readNDJSON(body)
+		if err != nil {
+			writeBodyError(writer, err)
+			return
+		}
+		handleAPIBatch(writer, key, items)
 		return
 	}
 
-	length := int(req.ContentLength)
+	buf, err := io.ReadAll(body)
+	if err != nil {
+		writeBodyError(writer, err)
+		return
+	}
 
-	buf := make([]byte, length)
-	if nr, _ := req.Body.Read(buf); nr != length {
-		Debugln("api/HandlePostAPIReq: Error reading Body. read %d bytes but expected %d",
-			nr, length)
-		writer.WriteHeader(http.StatusInternalServerError)
-		writer.Write([]byte("Error: Internal error reading request Body\n"))
+	if bytes.HasPrefix(bytes.TrimSpace(buf), []byte("[")) {
+		var raw []json.RawMessage
+		if err := json.Unmarshal(buf, &raw); err != nil {
+			Debugf("api/HandlePostAPIReq: Bad JSON format in batch POST request: %v", err)
+			writer.WriteHeader(http.StatusBadRequest)
+			writer.Write([]byte("Error: Bad JSON format in POST request\n"))
+			return
+		}
+		items := make([][]byte, len(raw))
+		for i, item := range raw {
+			items[i] = item
+		}
+		handleAPIBatch(writer, key, items)
 		return
 	}
 
@@ -45,16 +103,157 @@ func HandlePostAPIPublish(writer http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	Debugln("api/HandlePostAPIReq: Message received:", msg.String())
-
-	err = SERVER.publish(nil, msg)
+	pub, status, err := publishAPIMessage(key, msg)
 	if err != nil {
-		Debugf("api/HandlePostAPIReq: Bad message format in POST request: (message) %v, (error) %v",
-			msg.String(), err)
-		writer.WriteHeader(http.StatusBadRequest)
+		writer.WriteHeader(status)
 		writer.Write([]byte(fmt.Sprintf("Error: %v\n", err)))
 		return
 	}
 
+	// let the caller know the id the message was stamped with
+	reply, _ := json.Marshal(apiResult(pub))
+
+	writer.Header().Set("Content-Type", "application/json")
 	writer.WriteHeader(http.StatusOK)
+	writer.Write(reply)
+}
+
+// Reads the lines of an NDJSON Body as it streams in,
+// skipping blank lines
+func readNDJSON(body io.Reader) ([][]byte, error) {
+	var items [][]byte
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), API_MAX_BODY)
+	for scanner.Scan() {
+		if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+			items = append(items, append([]byte(nil), line...))
+		}
+	}
+	return items, scanner.Err()
+}
+
+// Writes the response for a request Body that couldn't be read
+func writeBodyError(writer http.ResponseWriter, err error) {
+	Debugf("api/HandlePostAPIReq: Error reading Body: %v", err)
+
+	if _, ok := err.(*http.MaxBytesError); ok || err == bufio.ErrTooLong {
+		writer.WriteHeader(http.StatusRequestEntityTooLarge)
+		writer.Write([]byte(fmt.Sprintf("Error: Request Body is larger than %d bytes\n", API_MAX_BODY)))
+		return
+	}
+	writer.WriteHeader(http.StatusBadRequest)
+	writer.Write([]byte("Error: Could not read request Body\n"))
+}
+
+// Publishes each message of a batch, and writes the
+// array of their results
+func handleAPIBatch(writer http.ResponseWriter, key *APIKey, items [][]byte) {
+
+	if len(items) > API_BATCH_LIMIT {
+		writer.WriteHeader(http.StatusRequestEntityTooLarge)
+		writer.Write([]byte(fmt.Sprintf("Error: A batch can have at most %d messages\n", API_BATCH_LIMIT)))
+		return
+	}
+
+	Debugf("api/HandlePostAPIReq: Batch of %d messages received", len(items))
+
+	// everything is queued before waiting on any receipts,
+	// so the batch goes out in order without stalling
+	pubs := make([]*DispatchReq, len(items))
+	results := make([]map[string]interface{}, len(items))
+
+	for i, item := range items {
+		msg, err := NewJsonMessage(item)
+		status := http.StatusBadRequest
+		if err == nil {
+			pubs[i], status, err = publishAPIMessage(key, msg)
+		} else {
+			err = fmt.Errorf("Bad JSON format: %v", err)
+		}
+		if err != nil {
+			results[i] = map[string]interface{}{
+				"error":  err.Error(),
+				"status": status,
+			}
+		}
+	}
+
+	for i, pub := range pubs {
+		if pub != nil {
+			results[i] = apiResult(pub)
+		}
+	}
+
+	reply, _ := json.Marshal(results)
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(reply)
+}
+
+// Checks a message against the api key and queues it for
+// dispatch. On failure, returns the http status for the error.
+func publishAPIMessage(key *APIKey, msg *message) (*DispatchReq, int, error) {
+
+	Debugln("api/HandlePostAPIReq: Message received:", msg.String())
+
+	if isPattern(msg.Channel) {
+		return nil, http.StatusBadRequest, ErrPatternPublish
+	}
+
+	if key != nil {
+		action := API_ACTION_PUBLISH
+		if msg.To != "" {
+			action = API_ACTION_DIRECT
+		} else if msg.Type == "command" {
+			action = API_ACTION_COMMAND
+		}
+
+		if !key.Allows(action, msg.Channel) {
+			Debugf("api/HandlePostAPIReq: API key %v can't %v to %q", key.Name, action, msg.Channel)
+			key.Used(false)
+			return nil, http.StatusForbidden, ErrAPIKeyDenied
+		}
+	}
+
+	// wait for the fan-out when the caller wants a receipt
+	pub := NewDispatchReq(nil, msg, msg.Ack)
+
+	err := SERVER.publishReq(pub)
+	if err == ErrIdentityOffline {
+		Debugf("api/HandlePostAPIReq: Direct message to unknown identity: %v", msg.To)
+		return nil, http.StatusNotFound, err
+
+	} else if err == ErrShuttingDown {
+		return nil, http.StatusServiceUnavailable, err
+
+	} else if err != nil {
+		Debugf("api/HandlePostAPIReq: Bad message format in POST request: (message) %v, (error) %v",
+			msg.String(), err)
+		return nil, http.StatusBadRequest, err
+	}
+
+	if key != nil {
+		key.Used(true)
+	}
+	return pub, http.StatusOK, nil
+}
+
+// Builds the result of a published message, waiting for
+// its delivery receipt if it asked for one
+func apiResult(pub *DispatchReq) map[string]interface{} {
+	result := map[string]interface{}{
+		"id":  pub.Msg.Id,
+		"seq": pub.Msg.Seq,
+	}
+
+	if pub.Ack {
+		<-pub.done
+		result["delivered"] = pub.Delivered
+		if pub.AckIdentities {
+			result["identities"] = pub.Identities
+		}
+	}
+	return result
 }
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func postPublish(body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "http://localhost/api/publish", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	HandlePostAPIPublish(rec, req)
+	return rec
+}
+
+// TestAPIPublish
+// Publishes through the api and checks the response
+// carries the assigned message id and sequence
+func TestAPIPublish(t *testing.T) {
+
+	SERVER = NewServerHandler(nil)
+	defer SERVER.Shutdown()
+
+	var ids []string
+	for i := 1; i <= 2; i++ {
+		rec := postPublish(`{"type":"message","channel":"news","data":{"msg":"hello"}}`)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status 200 but got %d: %s", rec.Code, rec.Body.String())
+		}
+
+		var reply struct {
+			Id  string
+			Seq uint64
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &reply); err != nil {
+			t.Fatalf("Response was not valid JSON: %v, error: %v", rec.Body.String(), err)
+		}
+		if reply.Id == "" || reply.Seq != uint64(i) {
+			t.Fatalf("Expected an id and sequence %d but got %+v", i, reply)
+		}
+		ids = append(ids, reply.Id)
+	}
+
+	if ids[0] == ids[1] {
+		t.Fatalf("Expected unique message ids but got %v", ids)
+	}
+
+	if rec := postPublish(`{"type":"message","channel":"news.*","data":{"msg":"hello"}}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected publishing to a wildcard channel to fail, but got %d", rec.Code)
+	}
+}
+
+// TestAPIPublishBatch
+// Publishes a JSON array and an NDJSON batch, and checks each
+// message gets its own result, in order
+func TestAPIPublishBatch(t *testing.T) {
+
+	SERVER = NewServerHandler(nil)
+	defer SERVER.Shutdown()
+
+	var results []struct {
+		Id        string
+		Seq       uint64
+		Delivered *int
+		Error     string
+		Status    int
+	}
+	decode := func(rec *httptest.ResponseRecorder) {
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status 200 but got %d: %s", rec.Code, rec.Body.String())
+		}
+		results = nil
+		if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+			t.Fatalf("Response was not valid JSON: %v, error: %v", rec.Body.String(), err)
+		}
+	}
+
+	decode(postPublish(`[
+		{"type":"message","channel":"news","data":{"n":1}},
+		{"type":"message","channel":"news.*","data":{"n":2}},
+		5,
+		{"type":"message","channel":"news","ack":true,"data":{"n":3}}
+	]`))
+	if len(results) != 4 {
+		t.Fatalf("Expected 4 results but got %+v", results)
+	}
+	if results[0].Seq != 1 || results[0].Id == "" || results[3].Seq != 2 || results[3].Delivered == nil {
+		t.Fatalf("Expected the good messages published in order, with a receipt for the last, but got %+v", results)
+	}
+	if results[1].Status != http.StatusBadRequest || results[1].Error != ErrPatternPublish.Error() ||
+		results[2].Status != http.StatusBadRequest || results[2].Error == "" {
+		t.Fatalf("Expected the pattern and non-object messages to fail but got %+v", results)
+	}
+
+	body := "{\"type\":\"message\",\"channel\":\"news\",\"data\":{\"n\":4}}\n" +
+		"{broken\n\n" +
+		"{\"type\":\"message\",\"to\":\"nobody\",\"data\":{\"n\":5}}\n" +
+		"{\"type\":\"message\",\"channel\":\"news\",\"data\":{\"n\":6}}\n"
+	// streamed, with no Content-Length
+	req := httptest.NewRequest("POST", "http://localhost/api/publish", io.MultiReader(strings.NewReader(body)))
+	req.Header.Set("Content-Type", NDJSON_CONTENT_TYPE)
+	if req.ContentLength != -1 {
+		t.Fatalf("Expected a request without a Content-Length but got %d", req.ContentLength)
+	}
+	rec := httptest.NewRecorder()
+	HandlePostAPIPublish(rec, req)
+
+	decode(rec)
+	if len(results) != 4 || results[0].Seq != 3 || results[3].Seq != 4 {
+		t.Fatalf("Expected the good lines published in order but got %+v", results)
+	}
+	if results[1].Status != http.StatusBadRequest || results[2].Status != http.StatusNotFound {
+		t.Fatalf("Expected the broken line and offline identity to fail but got %+v", results)
+	}
+
+	if rec := postPublish(`[{"type":"message"`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a broken array to fail but got %d", rec.Code)
+	}
+}
+
+// TestAPIPublishAck
+// Publishes with an ack to a channel with one subscriber,
+// and checks the receipt counts the delivery
+func TestAPIPublishAck(t *testing.T) {
+
+	SERVER = NewServerHandler(nil)
+	defer SERVER.Shutdown()
+
+	srv := httptest.NewServer(NewWebsocketHandler())
+	defer srv.Close()
+
+	ws := dialWebsocket(t, srv)
+	defer closeWebsocket(t, ws)
+
+	if err := websocket.Message.Send(ws, `{"type":"command","identity":"TEST1",`+
+		`"data":{"command":"init","options":{"channels":["news"]}}}`); err != nil {
+		t.Fatal("Send init:", err)
+	}
+	for reply := receiveMessage(t, ws); reply.Data["command"] != "onInit"; {
+		reply = receiveMessage(t, ws)
+	}
+
+	rec := postPublish(`{"type":"message","channel":"news","ack":true,"ack_identities":true,"data":{"msg":"hello"}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var receipt struct {
+		Id         string
+		Delivered  int
+		Identities []string
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &receipt); err != nil {
+		t.Fatalf("Response was not valid JSON: %v, error: %v", rec.Body.String(), err)
+	}
+	if receipt.Delivered != 1 || len(receipt.Identities) != 1 || receipt.Identities[0] != IDENT {
+		t.Fatalf("Expected delivery to 1 connection of %v but got %+v", IDENT, receipt)
+	}
+
+	msg := receiveMessage(t, ws)
+	if msg.Id != receipt.Id || strings.Contains(msg.raw, `"ack"`) {
+		t.Fatalf("Expected the published message without its ack fields, but got %v", msg.raw)
+	}
+}
+
+// TestAPIPublishAckBatch
+// Publishes a batch of acked messages to one channel, more
+// than its shard can queue, and checks each gets a receipt
+func TestAPIPublishAckBatch(t *testing.T) {
+
+	setTestConfig(t, func(conf *Config) { conf.DISPATCH_SHARDS = 16 })
+
+	SERVER = NewServerHandler(nil)
+	defer SERVER.Shutdown()
+
+	const n = 400
+	items := make([]string, n)
+	for i := range items {
+		items[i] = `{"type":"message","channel":"news","ack":true,"data":{"msg":"hello"}}`
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- postPublish("[" + strings.Join(items, ",") + "]") }()
+
+	var rec *httptest.ResponseRecorder
+	select {
+	case rec = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the batch receipts")
+	}
+
+	var results []map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil || len(results) != n {
+		t.Fatalf("Expected %d results but got %v, %v", n, len(results), err)
+	}
+	for i, result := range results {
+		if _, ok := result["delivered"]; !ok {
+			t.Fatalf("Expected a receipt for item %d but got %v", i, result)
+		}
+	}
+}
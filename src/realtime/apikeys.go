@@ -0,0 +1,267 @@
+package main
+
+/*
+	API Keys
+
+	Server-to-server callers of /api/publish authenticate with an
+	API key, sent as an "Authorization: Bearer <key>" header. Keys
+	are kept one per line in apikeys.txt (or the [API] keys-file):
+
+		# name    key                               channels         actions
+		billing   9c1f0e7d4b2a43e8a6f5d3c2b1a09876  orders.#,invoices publish,direct
+
+	channels is a comma separated list of channels or wildcard
+	patterns the key may publish to. actions is any of publish
+	(a message to a channel), command (a command to a channel)
+	and direct (a message with a to identity), or * for all of
+	them. Without actions, a key may only publish.
+
+	Once the file exists, every publish needs a key, and the Origin
+	licensing no longer applies to the api. Removing a key from the
+	file and sending a SIGHUP revokes it. Each key counts its
+	publishes and denials, and the counts are logged on a reload
+	and at shutdown.
+*/
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrAPIKeyRequired = errors.New("a valid API key is required")
+	ErrAPIKeyDenied   = errors.New("API key does not allow this")
+
+	apiKeyUsage     = make(map[string]*APIKeyUsage)
+	apiKeyUsageLock sync.Mutex
+)
+
+const (
+	APIKEYS_NAME = `apikeys.txt`
+
+	API_ACTION_PUBLISH = "publish"
+	API_ACTION_COMMAND = "command"
+	API_ACTION_DIRECT  = "direct"
+)
+
+type APIKey struct {
+	Name     string
+	Channels []string
+	Actions  []string
+}
+
+// Returns true if the key allows the action on the channel.
+// A direct message needs no channel.
+func (k *APIKey) Allows(action, channel string) bool {
+	allowed := false
+	for _, a := range k.Actions {
+		if a == action || a == "*" {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return false
+	}
+
+	if channel == "" {
+		return action == API_ACTION_DIRECT
+	}
+	for _, pattern := range k.Channels {
+		if patternCovers(pattern, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// Keys by their secret value. A nil APIKeys means there is
+// no keys file, and the api isn't key protected.
+type APIKeys map[string]*APIKey
+
+// Reads the keys file given in the config, or looks for an
+// apikeys.txt in the same places as the license. Returns nil
+// if there is no keys file.
+func NewAPIKeys(conf Config) (APIKeys, error) {
+	path := conf.API_KEYS_FILE
+	if path == "" {
+		parent, _ := filepath.Split(ROOT)
+		for _, p := range []string{
+			filepath.Join(ROOT, APIKEYS_NAME),
+			filepath.Join(parent, "etc", APIKEYS_NAME),
+			filepath.Join(ROOT, "etc", APIKEYS_NAME),
+		} {
+			if fileExists(p) {
+				path = p
+				break
+			}
+		}
+		if path == "" {
+			return nil, nil
+		}
+	} else if !filepath.IsAbs(path) {
+		path = filepath.Join(ROOT, path)
+	}
+
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	keys := make(APIKeys)
+	names := make(map[string]bool)
+
+	scanner := bufio.NewScanner(fh)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 3 || len(fields) > 4 {
+			return nil, fmt.Errorf("%v line %d: expected a name, key, channels and optional actions", path, n)
+		}
+
+		key := &APIKey{
+			Name:     fields[0],
+			Channels: strings.Split(fields[2], ","),
+			Actions:  []string{API_ACTION_PUBLISH},
+		}
+		if len(fields) == 4 {
+			key.Actions = strings.Split(fields[3], ",")
+		}
+
+		for _, action := range key.Actions {
+			switch action {
+			case API_ACTION_PUBLISH, API_ACTION_COMMAND, API_ACTION_DIRECT, "*":
+			default:
+				return nil, fmt.Errorf("%v line %d: unknown action %q", path, n, action)
+			}
+		}
+		for _, channel := range key.Channels {
+			if err = validatePattern(channel); channel == "" || err != nil {
+				return nil, fmt.Errorf("%v line %d: invalid channel %q", path, n, channel)
+			}
+		}
+
+		if _, ok := keys[fields[1]]; ok || names[key.Name] {
+			return nil, fmt.Errorf("%v line %d: duplicate key %v", path, n, key.Name)
+		}
+		keys[fields[1]] = key
+		names[key.Name] = true
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// Returns the key given in the Authorization header of
+// the request, or nil
+func (keys APIKeys) Lookup(req *http.Request) *APIKey {
+	if secret := bearerToken(req); secret != "" {
+		return keys[secret]
+	}
+	return nil
+}
+
+// Returns the names of the keys, sorted
+func (keys APIKeys) Names() []string {
+	names := make([]string, 0, len(keys))
+	for _, key := range keys {
+		names = append(names, key.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Describes the keys added and revoked between two key files
+func apiKeyChanges(old, keys APIKeys) []string {
+	var changes []string
+
+	switch {
+	case old == nil && keys != nil:
+		changes = append(changes, "API keys are now required to publish")
+	case old != nil && keys == nil:
+		changes = append(changes, "API keys are no longer required to publish")
+	}
+
+	before := make(map[string]bool, len(old))
+	for _, name := range old.Names() {
+		before[name] = true
+	}
+	for _, name := range keys.Names() {
+		if !before[name] {
+			changes = append(changes, "API key added: "+name)
+		}
+		delete(before, name)
+	}
+	for _, name := range old.Names() {
+		if before[name] {
+			changes = append(changes, "API key revoked: "+name)
+		}
+	}
+	return changes
+}
+
+// Usage counts for an API key, kept by name across reloads
+type APIKeyUsage struct {
+	Published uint64
+	Denied    uint64
+	LastUsed  int64 // unix seconds
+}
+
+func usageFor(key *APIKey) *APIKeyUsage {
+	apiKeyUsageLock.Lock()
+	defer apiKeyUsageLock.Unlock()
+
+	usage, ok := apiKeyUsage[key.Name]
+	if !ok {
+		usage = new(APIKeyUsage)
+		apiKeyUsage[key.Name] = usage
+	}
+	return usage
+}
+
+// Counts a publish, or a denial, against the key
+func (k *APIKey) Used(published bool) {
+	usage := usageFor(k)
+	if published {
+		atomic.AddUint64(&usage.Published, 1)
+	} else {
+		atomic.AddUint64(&usage.Denied, 1)
+	}
+	atomic.StoreInt64(&usage.LastUsed, time.Now().Unix())
+}
+
+// Logs the usage of every key that has been used
+func logAPIKeyUsage() {
+	apiKeyUsageLock.Lock()
+	defer apiKeyUsageLock.Unlock()
+
+	names := make([]string, 0, len(apiKeyUsage))
+	for name := range apiKeyUsage {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		usage := apiKeyUsage[name]
+		log.Printf("API key %v: %d published, %d denied, last used %v", name,
+			atomic.LoadUint64(&usage.Published), atomic.LoadUint64(&usage.Denied),
+			time.Unix(atomic.LoadInt64(&usage.LastUsed), 0).Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const testAPIKeys = `
+# name    key          channels          actions
+billing   billing-key  orders.#,invoices publish,direct
+ops       ops-key      #                 *
+reader    reader-key   news
+`
+
+func postPublishKey(key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "http://backend.example.com/api/publish", strings.NewReader(body))
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	rec := httptest.NewRecorder()
+	HandlePostAPIPublish(rec, req)
+	return rec
+}
+
+func TestAPIKeys(t *testing.T) {
+
+	defer func(root string) { ROOT = root }(ROOT)
+	ROOT = t.TempDir()
+
+	if keys, err := NewAPIKeys(Config{}); keys != nil || err != nil {
+		t.Fatalf("Expected no keys without a keys file but got %v, %v", keys, err)
+	}
+
+	writeTestFile(t, ROOT, APIKEYS_NAME, testAPIKeys)
+	keys, err := NewAPIKeys(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := strings.Join(keys.Names(), " "); names != "billing ops reader" {
+		t.Fatalf("Expected billing, ops and reader keys but got %v", names)
+	}
+
+	tests := []struct {
+		key, action, channel string
+		allowed              bool
+	}{
+		{"billing-key", API_ACTION_PUBLISH, "orders.eu.created", true},
+		{"billing-key", API_ACTION_PUBLISH, "invoices", true},
+		{"billing-key", API_ACTION_PUBLISH, "news", false},
+		{"billing-key", API_ACTION_COMMAND, "invoices", false},
+		{"billing-key", API_ACTION_DIRECT, "", true},
+		{"ops-key", API_ACTION_COMMAND, "anything.at.all", true},
+		{"reader-key", API_ACTION_PUBLISH, "news", true},
+		{"reader-key", API_ACTION_DIRECT, "", false},
+	}
+	for _, test := range tests {
+		if allowed := keys[test.key].Allows(test.action, test.channel); allowed != test.allowed {
+			t.Errorf("Expected %v %v on %q to be allowed=%v", test.key, test.action, test.channel, test.allowed)
+		}
+	}
+
+	for _, bad := range []string{
+		"nokey\n",
+		"a key channel publish extra\n",
+		"a key channel subscribe\n",
+		"a key orders.#.bad\n",
+		"a key1 news\na key2 news\n",
+	} {
+		writeTestFile(t, ROOT, APIKEYS_NAME, bad)
+		if _, err := NewAPIKeys(Config{}); err == nil {
+			t.Errorf("Expected an error reading keys file %q", bad)
+		}
+	}
+
+	changes := apiKeyChanges(keys, APIKeys{"ops-key": keys["ops-key"], "new-key": &APIKey{Name: "new"}})
+	if strings.Join(changes, "; ") != "API key added: new; API key revoked: billing; API key revoked: reader" {
+		t.Fatalf("Expected new added, billing and reader revoked but got %v", changes)
+	}
+}
+
+// TestAPIPublishKeys
+// Publishes through the api with and without keys, and checks
+// a key revoked by a reload stops working
+func TestAPIPublishKeys(t *testing.T) {
+
+	defer func(root string) { ROOT = root }(ROOT)
+	setTestConfig(t, func(*Config) {})
+
+	ROOT = t.TempDir()
+	writeTestFile(t, ROOT, CONF_NAME, "[Server]\ndebug = False\n")
+	writeTestFile(t, ROOT, APIKEYS_NAME, testAPIKeys)
+	if err := reloadConfig(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	SERVER = NewServerHandler(nil)
+	defer SERVER.Shutdown()
+
+	tests := []struct {
+		key, body string
+		code      int
+	}{
+		{"", `{"type":"message","channel":"invoices","data":{"n":1}}`, http.StatusUnauthorized},
+		{"wrong-key", `{"type":"message","channel":"invoices","data":{"n":1}}`, http.StatusUnauthorized},
+		{"billing-key", `{"type":"message","channel":"invoices","data":{"n":1}}`, http.StatusOK},
+		{"billing-key", `{"type":"message","channel":"news","data":{"n":1}}`, http.StatusForbidden},
+		{"billing-key", `{"type":"command","channel":"invoices","data":{"command":"refresh"}}`, http.StatusForbidden},
+		{"reader-key", `{"type":"message","to":"someone","data":{"n":1}}`, http.StatusForbidden},
+		{"ops-key", `{"type":"command","channel":"invoices","data":{"command":"refresh"}}`, http.StatusOK},
+	}
+	for _, test := range tests {
+		if rec := postPublishKey(test.key, test.body); rec.Code != test.code {
+			t.Errorf("Expected %v with key %q to get %d but got %d: %s", test.body, test.key, test.code, rec.Code, rec.Body.String())
+		}
+	}
+
+	usage := usageFor(currentAPIKeys()["billing-key"])
+	if atomic.LoadUint64(&usage.Published) < 1 || atomic.LoadUint64(&usage.Denied) < 2 {
+		t.Fatalf("Expected billing to count its publish and denials but got %+v", usage)
+	}
+
+	// revoke billing
+	writeTestFile(t, ROOT, APIKEYS_NAME, "ops ops-key #\n")
+	if err := reloadConfig(nil); err != nil {
+		t.Fatal(err)
+	}
+	if rec := postPublishKey("billing-key", `{"type":"message","channel":"invoices","data":{"n":1}}`); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected a revoked key to be refused but got %d", rec.Code)
+	}
+
+	// a broken keys file keeps the current keys
+	writeTestFile(t, ROOT, APIKEYS_NAME, "broken\n")
+	reloadConfig(nil)
+	if rec := postPublishKey("ops-key", `{"type":"message","channel":"invoices","data":{"n":1}}`); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the current keys to be kept but got %d", rec.Code)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+/*
+	Auth
+
+	With a key configured in the [Auth] section, a connection
+	proves who it is with a JWT in its init command:
+
+		{"type": "command", "data": {"command": "init", "options": {"token": "<jwt>"}}}
+
+	Tokens are signed with HS256 (jwt-secret) or RS256
+	(jwt-public-key). The "sub" claim sets the identity of the
+	connection, and an init asking for any other identity is
+	refused. An optional "channels" claim lists the channels, or
+	wildcard patterns, the connection may subscribe and publish to,
+	and an optional "roles" claim gives it roles for the channel
+	ACL rules. "exp" and "nbf" are checked when present.
+
+	Once auth is configured, an identity can only be claimed with
+	a token. Anonymous connections are still accepted unless
+	require-auth is set.
+*/
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	ErrAuthRequired  = errors.New("an auth token is required")
+	ErrAuthInvalid   = errors.New("auth token is invalid")
+	ErrAuthExpired   = errors.New("auth token has expired")
+	ErrAuthIdentity  = errors.New("identity does not match the auth token")
+	ErrChannelDenied = errors.New("auth token does not allow this channel")
+)
+
+// The claims of a verified auth token
+type AuthClaims struct {
+	Subject   string  `json:"sub"`
+	Expires   float64 `json:"exp"`
+	NotBefore float64 `json:"nbf"`
+
+	// the channels and patterns the connection may use. nil
+	// allows any channel, an empty list allows none
+	Channels []string `json:"channels"`
+
+	// roles for the ACL rules
+	Roles []string `json:"roles"`
+}
+
+// Returns true if the claims allow a channel, or every
+// channel a pattern can match
+func (a *AuthClaims) Allows(channel string) bool {
+	if a.Channels == nil {
+		return true
+	}
+	for _, allowed := range a.Channels {
+		if patternCovers(allowed, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+func authEnabled(conf *Config) bool {
+	return conf.AUTH_SECRET != "" || conf.AUTH_PUBLIC_KEY != nil
+}
+
+// Pulls the auth token out of an init command, from either
+// data.options.token (the format used by the js client)
+// or data.token
+func authToken(msg *message) string {
+	if opts, ok := msg.Data["options"].(map[string]interface{}); ok {
+		if token, ok := opts["token"].(string); ok {
+			return token
+		}
+	}
+	token, _ := msg.Data["token"].(string)
+	return token
+}
+
+// Pulls the auth token out of an HTTP request, from either a
+// token parameter or an "Authorization: Bearer" header
+func requestToken(req *http.Request) string {
+	if token := req.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	return bearerToken(req)
+}
+
+// Returns the token of an "Authorization: Bearer" header
+func bearerToken(req *http.Request) string {
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(auth[len("Bearer "):])
+	}
+	return ""
+}
+
+// Checks the auth token of an init command, and sets the
+// identity of the message from it. Returns nil claims for an
+// anonymous connection, or when auth isn't configured.
+func authenticate(msg *message) (*AuthClaims, error) {
+	conf := currentConfig()
+	if !authEnabled(conf) {
+		return nil, nil
+	}
+
+	token := authToken(msg)
+	if token == "" {
+		if msg.Identity != "" || conf.AUTH_REQUIRED {
+			return nil, ErrAuthRequired
+		}
+		return nil, nil
+	}
+
+	claims, err := parseAuthToken(token, conf, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if msg.Identity != "" && msg.Identity != claims.Subject {
+		return nil, ErrAuthIdentity
+	}
+	msg.Identity = claims.Subject
+	return claims, nil
+}
+
+// Verifies a JWT with the keys in the config, and returns
+// its claims. Only the algorithms of the configured keys
+// are accepted.
+func parseAuthToken(token string, conf *Config, now time.Time) (*AuthClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrAuthInvalid
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, ErrAuthInvalid
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[2], "="))
+	if err != nil {
+		return nil, ErrAuthInvalid
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	switch {
+	case header.Alg == "HS256" && conf.AUTH_SECRET != "":
+		mac := hmac.New(sha256.New, []byte(conf.AUTH_SECRET))
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, ErrAuthInvalid
+		}
+
+	case header.Alg == "RS256" && conf.AUTH_PUBLIC_KEY != nil:
+		sum := sha256.Sum256(signed)
+		if rsa.VerifyPKCS1v15(conf.AUTH_PUBLIC_KEY, crypto.SHA256, sum[:], sig) != nil {
+			return nil, ErrAuthInvalid
+		}
+
+	default:
+		return nil, ErrAuthInvalid
+	}
+
+	claims := new(AuthClaims)
+	if err = decodeJWTSegment(parts[1], claims); err != nil {
+		return nil, ErrAuthInvalid
+	}
+
+	unix := float64(now.Unix())
+	if claims.Expires != 0 && unix >= claims.Expires {
+		return nil, ErrAuthExpired
+	}
+	if claims.NotBefore != 0 && unix < claims.NotBefore {
+		return nil, ErrAuthInvalid
+	}
+	return claims, nil
+}
+
+func decodeJWTSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(seg, "="))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Reads an RSA public key from a PEM file, holding either
+// a PUBLIC KEY, an RSA PUBLIC KEY or a CERTIFICATE
+func loadPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%v is not a PEM file", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			key = cert.PublicKey
+		}
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%v does not hold an RSA public key", path)
+	}
+	return rsaKey, nil
+}
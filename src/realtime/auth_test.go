@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A Conn that hands each message it is sent to the test
+type recordConn struct {
+	id   string
+	msgs chan *message
+}
+
+func newRecordConn(id string) *recordConn {
+	return &recordConn{id: id, msgs: make(chan *message, 100)}
+}
+
+func (c *recordConn) String() string { return c.id }
+
+func (c *recordConn) Send(data interface{}) error {
+	c.msgs <- data.(*message)
+	return nil
+}
+
+func (c *recordConn) next(t *testing.T) *message {
+	select {
+	case msg := <-c.msgs:
+		return msg
+	case <-time.After(time.Second):
+		t.Fatalf("%v: Timed out waiting for a message", c.id)
+	}
+	return nil
+}
+
+// Skips ahead to the next message the test is interested in
+func (c *recordConn) until(t *testing.T, wanted func(msg *message) bool) *message {
+	for {
+		if msg := c.next(t); wanted(msg) {
+			return msg
+		}
+	}
+}
+
+func makeJWT(t *testing.T, alg string, claims map[string]interface{}, sign func(signed []byte) []byte) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func hs256(secret string) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(signed)
+		return mac.Sum(nil)
+	}
+}
+
+func TestParseAuthToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs256 := func(signed []byte) []byte {
+		sum := sha256.Sum256(signed)
+		sig, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+		return sig
+	}
+
+	// the public key is read from a file, as it is from the config
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	path := filepath.Join(t.TempDir(), "jwt.pem")
+	writeTestFile(t, filepath.Dir(path), filepath.Base(path), string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})))
+	publicKey, err := loadPublicKey(path)
+	if err != nil {
+		t.Fatal("loadPublicKey:", err)
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{"sub": "alice", "exp": now.Add(time.Hour).Unix(), "channels": []string{"news"}}
+
+	hsOnly := Config{AUTH_SECRET: "test secret"}
+	rsOnly := Config{AUTH_PUBLIC_KEY: publicKey}
+
+	tests := []struct {
+		name  string
+		conf  Config
+		token string
+		err   error
+	}{
+		{"HS256", hsOnly, makeJWT(t, "HS256", claims, hs256("test secret")), nil},
+		{"HS256 wrong secret", hsOnly, makeJWT(t, "HS256", claims, hs256("another secret")), ErrAuthInvalid},
+		{"RS256", rsOnly, makeJWT(t, "RS256", claims, rs256), nil},
+		{"RS256 without a public key", hsOnly, makeJWT(t, "RS256", claims, rs256), ErrAuthInvalid},
+		{"HS256 signed with the public key", rsOnly, makeJWT(t, "HS256", claims, hs256(string(der))), ErrAuthInvalid},
+		{"alg none", hsOnly, makeJWT(t, "none", claims, func([]byte) []byte { return nil }), ErrAuthInvalid},
+		{"expired", hsOnly, makeJWT(t, "HS256", map[string]interface{}{"sub": "alice", "exp": now.Add(-time.Minute).Unix()}, hs256("test secret")), ErrAuthExpired},
+		{"not yet valid", hsOnly, makeJWT(t, "HS256", map[string]interface{}{"sub": "alice", "nbf": now.Add(time.Hour).Unix()}, hs256("test secret")), ErrAuthInvalid},
+		{"malformed", hsOnly, "not.a-jwt", ErrAuthInvalid},
+	}
+
+	for _, test := range tests {
+		parsed, err := parseAuthToken(test.token, &test.conf, now)
+		if err != test.err {
+			t.Errorf("%v: Expected error %v but got %v", test.name, test.err, err)
+			continue
+		}
+		if err == nil && (parsed.Subject != "alice" || !parsed.Allows("news") || parsed.Allows("sports")) {
+			t.Errorf("%v: Expected alice's claims but got %+v", test.name, parsed)
+		}
+	}
+}
+
+// TestAuthInit
+// Inits connections with and without tokens, and checks the
+// token decides the identity and the channels allowed
+func TestAuthInit(t *testing.T) {
+
+	setTestConfig(t, func(conf *Config) {
+		conf.AUTH_SECRET = "test secret"
+		conf.OUTBOUND_QUEUE = 0
+	})
+
+	server := NewServerHandler(nil)
+	defer server.Shutdown()
+
+	token := func(claims map[string]interface{}) string {
+		return makeJWT(t, "HS256", claims, hs256("test secret"))
+	}
+	send := func(c Conn, format string, args ...interface{}) {
+		server.OnRawMessage(c, []byte(fmt.Sprintf(format, args...)))
+	}
+	isInit := func(c Conn) bool {
+		server.clientsLock.RLock()
+		defer server.clientsLock.RUnlock()
+		_, ok := server.clients[c.String()]
+		return ok
+	}
+
+	// anonymous connections are still welcome
+	anon := newRecordConn("anon")
+	send(anon, `{"type":"command","data":{"command":"init"}}`)
+	if !isInit(anon) {
+		t.Fatal("Expected an anonymous connection to init")
+	}
+
+	// but identities need a token
+	bob := newRecordConn("bob")
+	send(bob, `{"type":"command","identity":"bob","data":{"command":"init"}}`)
+	if msg := bob.next(t); msg.Error != ErrAuthRequired.Error() || isInit(bob) {
+		t.Fatalf("Expected an identity without a token to be refused, but got %+v", msg)
+	}
+
+	send(bob, `{"type":"command","identity":"bob","data":{"command":"init","options":{"token":%q}}}`,
+		token(map[string]interface{}{"sub": "alice"}))
+	if msg := bob.next(t); msg.Error != ErrAuthIdentity.Error() || isInit(bob) {
+		t.Fatalf("Expected another identity's token to be refused, but got %+v", msg)
+	}
+
+	// the token sets the identity and the channels
+	alice := newRecordConn("alice")
+	send(alice, `{"type":"command","data":{"command":"init","options":{"token":%q,"channels":["news","secret"]}}}`,
+		token(map[string]interface{}{"sub": "alice", "channels": []string{"news", "alice.*"}}))
+
+	isError := func(msg *message) bool { return msg.Error != "" }
+	isCommand := func(command string) func(*message) bool {
+		return func(msg *message) bool { return isError(msg) || msg.Data["command"] == command }
+	}
+
+	msg := alice.until(t, isCommand("onInit"))
+	if msg.Data["command"] != "onInit" || msg.Identity != "alice" {
+		t.Fatalf("Expected an onInit reply for alice but got %+v", msg)
+	}
+	if rejected, _ := msg.Data["rejected"].(map[string]string); rejected["secret"] != ErrChannelDenied.Error() {
+		t.Fatalf("Expected the secret channel to be rejected but got %v", msg.Data["rejected"])
+	}
+
+	send(alice, `{"type":"command","channel":"alice.inbox","data":{"command":"subscribe"}}`)
+	if msg := alice.until(t, isCommand("onSubscribe")); msg.Data["command"] != "onSubscribe" || msg.Channel != "alice.inbox" {
+		t.Fatalf("Expected alice to subscribe to alice.inbox but got %+v", msg)
+	}
+
+	for _, raw := range []string{
+		`{"type":"command","channel":"secret","data":{"command":"subscribe"}}`,
+		`{"type":"command","channel":"*","data":{"command":"subscribe"}}`,
+		`{"type":"message","channel":"secret","data":{"msg":"hi"}}`,
+	} {
+		send(alice, "%s", raw)
+		if msg := alice.until(t, isError); msg.Error != ErrChannelDenied.Error() {
+			t.Fatalf("Expected %v to be denied but got %+v", raw, msg)
+		}
+	}
+
+	setTestConfig(t, func(conf *Config) { conf.AUTH_REQUIRED = true })
+
+	anon2 := newRecordConn("anon2")
+	send(anon2, `{"type":"command","data":{"command":"init"}}`)
+	if msg := anon2.next(t); msg.Error != ErrAuthRequired.Error() || isInit(anon2) {
+		t.Fatalf("Expected an anonymous connection to be refused with require-auth, but got %+v", msg)
+	}
+
+	for _, c := range []Conn{anon, alice} {
+		server.OnDisconnect(c)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+/*
+	Auth Hook
+
+	With a url set in the [Auth] section, the application decides
+	whether each subscribe and client publish is allowed. The server
+	POSTs a JSON request to the url before honoring it:
+
+		{"action": "subscribe", "identity": "alice", "channel": "news",
+		 "to": "", "connection": "<connection id>"}
+
+	A 2xx response allows it, 401 or 403 denies it. Decisions are
+	cached for cache-ttl seconds, by identity (or connection, for
+	anonymous clients), channel and action. Anything else, such as
+	a timeout or a 500, is a failure, which denies the request
+	unless fail-open is set. Failures aren't cached.
+
+	The hook is called from the connection's goroutine, never
+	from a dispatch shard, so a slow auth url only holds up the
+	client waiting on it. The channels of an init are asked
+	about all at once, under a single timeout.
+*/
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	ErrAuthDenied      = errors.New("not authorized")
+	ErrAuthUnavailable = errors.New("authorization is unavailable")
+)
+
+const (
+	AUTH_ACTION_SUBSCRIBE = "subscribe"
+	AUTH_ACTION_PUBLISH   = "publish"
+)
+
+type authRequest struct {
+	Action     string `json:"action"`
+	Identity   string `json:"identity"`
+	Channel    string `json:"channel"`
+	To         string `json:"to,omitempty"`
+	Connection string `json:"connection"`
+}
+
+type authDecision struct {
+	allow   bool
+	expires time.Time
+}
+
+type AuthHook struct {
+	client *http.Client
+
+	cache     map[string]authDecision
+	lastSweep time.Time
+	lock      sync.Mutex
+}
+
+func NewAuthHook() *AuthHook {
+	return &AuthHook{
+		client: &http.Client{},
+		cache:  make(map[string]authDecision),
+	}
+}
+
+// Asks the auth url whether the connection may perform the action
+// on the channel of msg. Returns nil if it may, or if there is no
+// auth url, otherwise ErrAuthDenied or ErrAuthUnavailable.
+func (h *AuthHook) Authorize(c Conn, msg *message, action string) error {
+	conf := currentConfig()
+	if conf.AUTH_URL == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(conf.AUTH_TIMEOUT)*time.Second)
+	defer cancel()
+
+	return h.authorize(ctx, conf, c, msg, action)
+}
+
+// Authorizes the identity's action on each of the channels. The
+// requests go out together and share one timeout, so any number
+// of channels takes no longer than one. Returns one error per
+// channel.
+func (h *AuthHook) AuthorizeChannels(c Conn, identity string, channels []string, action string) []error {
+	errs := make([]error, len(channels))
+
+	conf := currentConfig()
+	if conf.AUTH_URL == nil {
+		return errs
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(conf.AUTH_TIMEOUT)*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i, channel := range channels {
+		wg.Add(1)
+		go func(i int, msg *message) {
+			defer wg.Done()
+			errs[i] = h.authorize(ctx, conf, c, msg, action)
+		}(i, &message{Identity: identity, Channel: channel})
+	}
+	wg.Wait()
+
+	return errs
+}
+
+func (h *AuthHook) authorize(ctx context.Context, conf *Config, c Conn, msg *message, action string) error {
+	req := &authRequest{
+		Action:     action,
+		Identity:   msg.Identity,
+		Channel:    msg.Channel,
+		To:         msg.To,
+		Connection: c.String(),
+	}
+
+	who := "@" + msg.Identity
+	if msg.Identity == "" {
+		who = c.String()
+	}
+	key := action + "\x00" + who + "\x00" + msg.Channel + "\x00" + msg.To
+
+	if allow, ok := h.cached(key); ok {
+		return authResult(allow)
+	}
+
+	allow, err := h.ask(ctx, conf, req)
+	if err != nil {
+		log.Printf("[WARN] AuthHook: %v %v on %q failed: %v", who, action, msg.Channel, err)
+		if conf.AUTH_FAIL_OPEN {
+			return nil
+		}
+		return ErrAuthUnavailable
+	}
+
+	h.store(key, allow, time.Duration(conf.AUTH_CACHE_TTL)*time.Second)
+	return authResult(allow)
+}
+
+func authResult(allow bool) error {
+	if allow {
+		return nil
+	}
+	return ErrAuthDenied
+}
+
+// POSTs the request to the auth url, and returns its decision
+func (h *AuthHook) ask(ctx context.Context, conf *Config, req *authRequest) (allow bool, err error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return false, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", conf.AUTH_URL.String(), bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.client.Do(httpReq)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return true, nil
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden:
+		return false, nil
+	}
+	return false, errors.New(resp.Status)
+}
+
+func (h *AuthHook) cached(key string) (allow, ok bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	decision, ok := h.cache[key]
+	if !ok || !time.Now().Before(decision.expires) {
+		return false, false
+	}
+	return decision.allow, true
+}
+
+// Caches a decision. Expired decisions are swept out once
+// a ttl, so the cache only holds about a ttl's worth.
+func (h *AuthHook) store(key string, allow bool, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(h.lastSweep) > ttl {
+		for k, decision := range h.cache {
+			if !now.Before(decision.expires) {
+				delete(h.cache, k)
+			}
+		}
+		h.lastSweep = now
+	}
+
+	h.cache[key] = authDecision{allow: allow, expires: now.Add(ttl)}
+}
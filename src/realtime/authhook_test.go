@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A stand-in for the application's auth url. It denies the
+// "secret" channel, fails on the "broken" channel, takes its
+// time over "slow." channels, and allows anything else.
+type authStandIn struct {
+	lock     sync.Mutex
+	requests []authRequest
+}
+
+func (a *authStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req authRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || r.Method != "POST" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	a.lock.Lock()
+	a.requests = append(a.requests, req)
+	a.lock.Unlock()
+
+	if strings.HasPrefix(req.Channel, "slow.") {
+		time.Sleep(600 * time.Millisecond)
+	}
+
+	switch req.Channel {
+	case "secret":
+		w.WriteHeader(http.StatusForbidden)
+	case "broken":
+		w.WriteHeader(http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (a *authStandIn) count() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return len(a.requests)
+}
+
+func startAuthStandIn(t *testing.T) (*authStandIn, *url.URL) {
+	standIn := new(authStandIn)
+	srv := httptest.NewServer(standIn)
+	t.Cleanup(srv.Close)
+
+	u, _ := url.Parse(srv.URL + "/api/realtime/auth")
+	return standIn, u
+}
+
+func setAuthConfig(set func(conf *Config)) {
+	configLock.Lock()
+	set(&CONFIG)
+	applyConfig()
+	configLock.Unlock()
+}
+
+func TestAuthHook(t *testing.T) {
+
+	standIn, u := startAuthStandIn(t)
+	setTestConfig(t, func(conf *Config) {
+		conf.AUTH_URL = u
+		conf.AUTH_CACHE_TTL = 60
+	})
+
+	hook := NewAuthHook()
+	conn := &benchConn{id: "hook-1"}
+
+	msg := NewMessage()
+	msg.Identity = "alice"
+	msg.Channel = "news"
+
+	if err := hook.Authorize(conn, msg, AUTH_ACTION_SUBSCRIBE); err != nil {
+		t.Fatal("Expected news to be allowed but got", err)
+	}
+	req := standIn.requests[0]
+	if req.Action != AUTH_ACTION_SUBSCRIBE || req.Identity != "alice" || req.Channel != "news" || req.Connection != "hook-1" {
+		t.Fatalf("Expected the auth request to describe the subscribe but got %+v", req)
+	}
+
+	// cached, by identity
+	hook.Authorize(&benchConn{id: "hook-2"}, msg, AUTH_ACTION_SUBSCRIBE)
+	if n := standIn.count(); n != 1 {
+		t.Fatalf("Expected the decision to be cached but the auth url was called %d times", n)
+	}
+
+	// but not across actions
+	if err := hook.Authorize(conn, msg, AUTH_ACTION_PUBLISH); err != nil || standIn.count() != 2 {
+		t.Fatalf("Expected a publish to be asked about separately, got %v after %d requests", err, standIn.count())
+	}
+
+	msg.Channel = "secret"
+	for i := 0; i < 2; i++ {
+		if err := hook.Authorize(conn, msg, AUTH_ACTION_SUBSCRIBE); err != ErrAuthDenied {
+			t.Fatal("Expected secret to be denied but got", err)
+		}
+	}
+	if n := standIn.count(); n != 3 {
+		t.Fatalf("Expected the denial to be cached but the auth url was called %d times", n)
+	}
+
+	// failures aren't cached, and fail closed unless fail-open
+	msg.Channel = "broken"
+	if err := hook.Authorize(conn, msg, AUTH_ACTION_SUBSCRIBE); err != ErrAuthUnavailable {
+		t.Fatal("Expected a failing auth url to fail closed but got", err)
+	}
+	setAuthConfig(func(conf *Config) { conf.AUTH_FAIL_OPEN = true })
+	if err := hook.Authorize(conn, msg, AUTH_ACTION_SUBSCRIBE); err != nil {
+		t.Fatal("Expected a failing auth url to fail open but got", err)
+	}
+	if n := standIn.count(); n != 5 {
+		t.Fatalf("Expected failures to be asked again but the auth url was called %d times", n)
+	}
+
+	setAuthConfig(func(conf *Config) { conf.AUTH_CACHE_TTL = 0 })
+	msg.Channel = "sports"
+	hook.Authorize(conn, msg, AUTH_ACTION_SUBSCRIBE)
+	hook.Authorize(conn, msg, AUTH_ACTION_SUBSCRIBE)
+	if n := standIn.count(); n != 7 {
+		t.Fatalf("Expected a cache-ttl of 0 to ask every time but the auth url was called %d times", n)
+	}
+
+	setAuthConfig(func(conf *Config) { conf.AUTH_URL = nil })
+	msg.Channel = "secret"
+	if err := hook.Authorize(conn, msg, AUTH_ACTION_SUBSCRIBE); err != nil {
+		t.Fatal("Expected everything to be allowed without an auth url but got", err)
+	}
+}
+
+// TestAuthHookServer
+// Checks the server asks the auth hook before subscribes and
+// client publishes, and replies with an error when denied
+func TestAuthHookServer(t *testing.T) {
+
+	standIn, u := startAuthStandIn(t)
+	setTestConfig(t, func(conf *Config) {
+		conf.AUTH_URL = u
+		conf.OUTBOUND_QUEUE = 0
+	})
+
+	server := NewServerHandler(nil)
+	defer server.Shutdown()
+
+	conn := newRecordConn("hook-server")
+	defer server.OnDisconnect(conn)
+
+	isError := func(msg *message) bool { return msg.Error != "" }
+
+	server.OnRawMessage(conn, []byte(`{"type":"command","data":{"command":"init","channels":["news","secret"]}}`))
+	msg := conn.until(t, func(msg *message) bool { return msg.Data["command"] == "onInit" })
+	if rejected, _ := msg.Data["rejected"].(map[string]string); rejected["secret"] != ErrAuthDenied.Error() || rejected["news"] != ErrInitRejected.Error() {
+		t.Fatalf("Expected the secret channel to be denied, and news to go with it, but got %v", msg.Data["rejected"])
+	}
+
+	for _, raw := range []string{
+		`{"type":"command","channel":"secret","data":{"command":"subscribe"}}`,
+		`{"type":"message","channel":"secret","data":{"msg":"hi"}}`,
+		`{"type":"command","channel":"secret","data":{"command":"custom"}}`,
+	} {
+		server.OnRawMessage(conn, []byte(raw))
+		if msg := conn.until(t, isError); msg.Error != ErrAuthDenied.Error() || msg.Channel != "secret" {
+			t.Fatalf("Expected %v to be denied but got %+v", raw, msg)
+		}
+	}
+
+	// unsubscribes and presence don't ask
+	before := standIn.count()
+	server.OnRawMessage(conn, []byte(`{"type":"command","channel":"news","data":{"command":"presence"}}`))
+	server.OnRawMessage(conn, []byte(`{"type":"command","channel":"news","data":{"command":"unsubscribe"}}`))
+	if n := standIn.count(); n != before {
+		t.Fatalf("Expected no auth requests for presence and unsubscribe but got %d", n-before)
+	}
+}
+
+// TestAuthHookInitChannels
+// Inits with several channels the auth url is slow to answer,
+// and checks they are asked about together, within one timeout
+func TestAuthHookInitChannels(t *testing.T) {
+
+	standIn, u := startAuthStandIn(t)
+	setTestConfig(t, func(conf *Config) {
+		conf.AUTH_URL = u
+		conf.AUTH_TIMEOUT = 1
+		conf.OUTBOUND_QUEUE = 0
+	})
+
+	server := NewServerHandler(nil)
+	defer server.Shutdown()
+
+	conn := newRecordConn("hook-init")
+	defer server.OnDisconnect(conn)
+
+	start := time.Now()
+	server.OnRawMessage(conn, []byte(`{"type":"command","data":{"command":"init","channels":["slow.a","slow.b","slow.c"]}}`))
+	elapsed := time.Since(start)
+
+	msg := conn.until(t, func(msg *message) bool { return msg.Data["command"] == "onInit" })
+	if subscribed, _ := msg.Data["subscribed"].([]string); len(subscribed) != 3 {
+		t.Fatalf("Expected all 3 channels to be subscribed but got %v, %v", msg.Data["subscribed"], msg.Data["rejected"])
+	}
+	if n := standIn.count(); n != 3 {
+		t.Fatalf("Expected 3 auth requests but got %d", n)
+	}
+	if elapsed >= time.Second {
+		t.Fatalf("Expected the channels to be asked about together, but the init took %v", elapsed)
+	}
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"github.com/justinfx/go-socket.io/socketio"
 
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -141,3 +144,83 @@ func BenchmarkStressTest(b *testing.B) {
 
 	log.Printf("Sent %v messages * %v concurrent clients = %v messages", numMessages, clients, numMessages*clients)
 }
+
+// A Conn that encodes each message, the way a transport
+// would, and counts them
+type benchConn struct {
+	id       string
+	received uint64
+}
+
+func (c *benchConn) String() string { return c.id }
+
+func (c *benchConn) Send(data interface{}) error {
+	if _, err := json.Marshal(data); err != nil {
+		return err
+	}
+	atomic.AddUint64(&c.received, 1)
+	return nil
+}
+
+// BenchmarkDispatch
+// Publishes messages spread over many channels straight into
+// the ServerHandler, with different numbers of dispatch shards.
+// Compare the ns/op of each shard count to see how dispatch
+// scales with cores.
+//
+//	go test -run NONE -bench Dispatch
+func BenchmarkDispatch(b *testing.B) {
+	for _, shards := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			benchmarkDispatch(b, shards, 64, 10)
+		})
+	}
+}
+
+func benchmarkDispatch(b *testing.B, shards, channels, subscribers int) {
+	setTestConfig(b, func(conf *Config) {
+		conf.DISPATCH_SHARDS = shards
+		conf.OUTBOUND_QUEUE = 0
+		conf.HISTORY_SIZE = 0
+	})
+
+	server := NewServerHandler(nil)
+	defer server.Shutdown()
+
+	names := make([]string, channels)
+	for i := range names {
+		names[i] = fmt.Sprintf("bench.%d", i)
+	}
+
+	for i := 0; i < channels*subscribers; i++ {
+		conn := &benchConn{id: fmt.Sprintf("bench-%d", i)}
+
+		initMsg := NewCommand()
+		initMsg.Data["command"] = "init"
+		server.initCmd(NewDispatchReq(conn, initMsg, false))
+
+		sub := NewCommand()
+		sub.Channel = names[i%channels]
+		sub.Data["command"] = "subscribe"
+		server.subscribeCmd(NewDispatchReq(conn, sub, true))
+	}
+
+	payload := strings.Repeat("X", 100)
+	var next uint64
+
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			msg := NewMessage()
+			msg.Channel = names[atomic.AddUint64(&next, 1)%uint64(channels)]
+			msg.Data["msg"] = payload
+			if err := server.publish(nil, msg); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+
+	server.flushMessages()
+}
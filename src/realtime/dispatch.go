@@ -0,0 +1,776 @@
+package main
+
+/*
+	Dispatch
+
+	Message routing is split across a number of shards, each
+	owning the channels whose names hash to it. A shard's goroutine
+	is the only one to touch the subscriptions, history and sequences
+	of its channels, so messages on different channels are dispatched
+	in parallel, while the messages of any one channel stay in order.
+
+	Wildcard subscriptions can match channels on every shard, so
+	their members are kept in a shared index under patternsLock.
+*/
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// how often a shard forgets the channels no one is using
+	SWEEP_INTERVAL = time.Minute
+)
+
+type shard struct {
+	server *ServerHandler
+
+	// only touched by the shard goroutine
+	subs    map[string][]*Client
+	history map[string]*History
+
+	// the last serial dropped from a history that has since
+	// been swept away, so a replay from before it is known
+	// to be truncated
+	swept uint64
+
+	// stamping and queueing a message happen together under
+	// the lock, so sequences are in the order of dispatch
+	sequences   map[string]uint64
+	publishLock sync.Mutex
+
+	msgChannel  chan *DispatchReq
+	srvcChannel chan *DispatchReq
+}
+
+func newShard(s *ServerHandler, queueSize int) *shard {
+	return &shard{
+		server:      s,
+		subs:        make(map[string][]*Client),
+		history:     make(map[string]*History),
+		sequences:   make(map[string]uint64),
+		msgChannel:  make(chan *DispatchReq, queueSize),
+		srvcChannel: make(chan *DispatchReq, 500),
+	}
+}
+
+// Returns the shard that owns a channel
+func (s *ServerHandler) shardFor(channel string) *shard {
+	if len(s.shards) == 1 {
+		return s.shards[0]
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(channel))
+	return s.shards[hash.Sum32()%uint32(len(s.shards))]
+}
+
+// Direct messages are ordered by the identity they are sent to.
+// The prefix keeps them from sharing a key with a channel name.
+func (s *ServerHandler) shardForIdentity(identity string) *shard {
+	return s.shardFor("@" + identity)
+}
+
+// Stamp the message with its id and channel sequence
+// and queue it for dispatch
+func (sh *shard) publish(req *DispatchReq) error {
+	msg := req.Msg
+
+	sh.publishLock.Lock()
+	defer sh.publishLock.Unlock()
+
+	sh.server.stamp(msg)
+
+	if msg.To == "" {
+		sh.sequences[msg.Channel]++
+		msg.Seq = sh.sequences[msg.Channel]
+	} else {
+		msg.Seq = 0
+	}
+
+	if !sh.server.enqueue(sh.msgChannel, req) {
+		return ErrShuttingDown
+	}
+	return nil
+}
+
+// The shard goroutine. Service messages include subscribe,
+// unsubscribe and presence commands, and are checked first
+// so that a flood of messages doesn't hold them up.
+func (sh *shard) run() {
+
+	var (
+		req *DispatchReq
+		ok  bool
+	)
+
+	srvc, msgs := sh.srvcChannel, sh.msgChannel
+
+	sweep := time.NewTicker(SWEEP_INTERVAL)
+	defer sweep.Stop()
+
+	for srvc != nil || msgs != nil {
+
+		select {
+		case req, ok = <-srvc:
+			if !ok {
+				srvc = nil
+			} else {
+				sh.dispatchService(req)
+			}
+			continue
+		default:
+		}
+
+		select {
+		case req, ok = <-srvc:
+			if !ok {
+				srvc = nil
+			} else {
+				sh.dispatchService(req)
+			}
+
+		case req, ok = <-msgs:
+			if !ok {
+				msgs = nil
+			} else {
+				sh.dispatchMessage(req)
+			}
+
+		case <-sweep.C:
+			sh.sweepChannels()
+		}
+	}
+
+	sh.server.quit <- true
+}
+
+// Delivers a message to all members of its channel, or
+// to the identity it is addressed to
+func (sh *shard) dispatchMessage(req *DispatchReq) {
+	msg := req.Msg
+
+	switch {
+	case msg.To != "":
+		sh.sendDirect(req)
+
+	case msg.Channel != "":
+		sh.sendChannel(req)
+	}
+
+	if req.Ack {
+		sh.sendReceipt(req)
+	}
+
+	req.SetDone()
+}
+
+// Processes (un)subscription and presence commands
+func (sh *shard) dispatchService(req *DispatchReq) {
+
+	var (
+		msg    = req.Msg
+		client *Client
+		err    error
+	)
+
+	sh.server.clientsLock.RLock()
+	client = sh.server.clients[req.Conn.String()]
+	sh.server.clientsLock.RUnlock()
+
+	if client == nil {
+		req.Err = errors.New("connection has no Client record")
+		req.SetDone()
+		return
+	}
+
+	command, _ := msg.Data["command"].(string)
+
+	switch command {
+
+	case "init":
+		// batch subscribe. all of the channels this shard owns
+		// are processed in one go, so no other (un)subscribe
+		// can be interleaved
+		req.Errs = make([]error, len(req.Channels))
+		for i, channel := range req.Channels {
+			sub := NewCommand()
+			sub.Channel = channel
+			sub.Identity = msg.Identity
+			sub.Data["command"] = "subscribe"
+
+			if err = sh.subscribe(req.Conn, client, sub); err != nil {
+				Debugln(err)
+				req.Errs[i] = err
+			}
+		}
+
+	case "subscribe":
+		err = sh.subscribe(req.Conn, client, msg)
+		if err == nil || err == ErrAlreadySubscribed {
+			// nothing else is dispatched on the channel until
+			// the replay is done, so the client doesn't miss
+			// anything in between
+			sh.replayHistory(req.Conn, msg)
+		}
+		if err != nil {
+			Debugln(err)
+			req.Err = err
+		}
+
+		if aclErr, ok := err.(*ACLError); ok {
+			req.Conn.Send(aclErr.Reply())
+		}
+
+	case "unsubscribe":
+		if err = sh.unsubscribe(req.Conn, client, msg); err != nil {
+			Debugln(err)
+			req.Err = err
+		}
+
+	case "presence":
+		err = sh.server.checkACL(req.Conn, client.Identity, ACL_PRESENCE, msg.Channel)
+		if aclErr, ok := err.(*ACLError); ok {
+			Debugln(err)
+			req.Err = err
+			req.Conn.Send(aclErr.Reply())
+		} else if err = sh.presence(req.Conn, msg); err != nil {
+			Debugln(err)
+			req.Err = err
+		}
+
+	default:
+		req.Err = ErrMalformedCommand
+	}
+
+	req.SetDone()
+}
+
+// Returns the subscribers of a channel or wildcard pattern.
+// The returned slice must not be modified.
+func (sh *shard) members(channel string) []*Client {
+	if isPattern(channel) {
+		sh.server.patternsLock.RLock()
+		defer sh.server.patternsLock.RUnlock()
+
+		return sh.server.patternSubs[channel]
+	}
+	return sh.subs[channel]
+}
+
+// Replaces the subscribers of a channel or wildcard pattern,
+// keeping the pattern index up to date
+func (sh *shard) setMembers(channel string, members []*Client) {
+	if !isPattern(channel) {
+		if len(members) == 0 {
+			delete(sh.subs, channel)
+		} else {
+			sh.subs[channel] = members
+		}
+		return
+	}
+
+	s := sh.server
+	s.patternsLock.Lock()
+	defer s.patternsLock.Unlock()
+
+	if len(members) == 0 {
+		s.patterns.Remove(channel)
+		delete(s.patternSubs, channel)
+		return
+	}
+	if _, ok := s.patternSubs[channel]; !ok {
+		s.patterns.Add(channel)
+	}
+	s.patternSubs[channel] = members
+}
+
+// Returns the Clients that should receive a message published
+// to the channel: the exact subscribers, plus the subscribers of
+// any wildcard pattern matching the channel.
+// Messages sent to a pattern itself (such as the onSubscribe reply
+// for a wildcard subscription) only go to that pattern's subscribers.
+func (sh *shard) channelMembers(channel string) []*Client {
+	if isPattern(channel) {
+		return sh.members(channel)
+	}
+
+	members := sh.subs[channel]
+
+	s := sh.server
+	s.patternsLock.RLock()
+	defer s.patternsLock.RUnlock()
+
+	patterns := s.patterns.Match(channel)
+	if len(patterns) == 0 {
+		return members
+	}
+
+	// a Client could be subscribed to the channel and
+	// several patterns, but should only get the message once
+	seen := make(map[*Client]bool, len(members))
+	all := make([]*Client, 0, len(members))
+	for _, client := range members {
+		seen[client] = true
+		all = append(all, client)
+	}
+	for _, p := range patterns {
+		for _, client := range s.patternSubs[p] {
+			if !seen[client] {
+				seen[client] = true
+				all = append(all, client)
+			}
+		}
+	}
+	return all
+}
+
+// Delivers a message to every connection subscribed to its
+// channel, counting the deliveries on the request.
+func (sh *shard) sendChannel(req *DispatchReq) {
+	msg := req.Msg
+
+	sh.recordHistory(msg)
+
+	//Debugln("startDispatcher(): Sending message w/ data - ", msg.Data)
+
+	sender := sh.sender(req)
+
+	for _, client := range sh.channelMembers(msg.Channel) {
+		sent := deliver(req, sender, client)
+		req.Delivered += sent
+		if sent > 0 && req.AckIdentities && client.Identity != "" {
+			req.Identities = append(req.Identities, client.Identity)
+		}
+	}
+}
+
+// Returns the Client that published the request, or nil
+// if it came from the server
+func (sh *shard) sender(req *DispatchReq) *Client {
+	if req.Conn == nil {
+		return nil
+	}
+	sh.server.clientsLock.RLock()
+	defer sh.server.clientsLock.RUnlock()
+
+	return sh.server.clients[req.Conn.String()]
+}
+
+// Sends the message of the request to a Client, leaving out
+// the publisher's own connection, or all of its identity's
+// connections, if it asked to be excluded. The message's
+// exclude option takes precedence over the subscription's.
+func deliver(req *DispatchReq, sender, client *Client) int {
+	if client != sender {
+		return client.Send(req.Msg)
+	}
+
+	exclude := req.Exclude
+	if exclude == "" {
+		exclude = client.ExcludeFor(req.Msg.Channel)
+	}
+
+	switch exclude {
+	case EXCLUDE_IDENTITY:
+		return 0
+	case EXCLUDE_CONNECTION:
+		return client.SendExcept(req.Msg, req.Conn)
+	}
+	return client.Send(req.Msg)
+}
+
+// Sends a reply from the server to the members of its channel.
+// The reply is dispatched immediately, rather than queued, since
+// it comes from the goroutine that owns the channel. Replies
+// have no publisher, so no one is excluded from them.
+func (sh *shard) sendReply(reply *message) {
+	sh.server.stamp(reply)
+	sh.sendChannel(NewDispatchReq(nil, reply, false))
+}
+
+// Replies to the publisher with an onPublish receipt, saying
+// how many connections the message was delivered to.
+func (sh *shard) sendReceipt(req *DispatchReq) {
+	if req.Conn == nil {
+		// the api reads the receipt off the request
+		return
+	}
+
+	msg := req.Msg
+
+	reply := NewCommand()
+	reply.Channel = msg.Channel
+	reply.Identity = msg.Identity
+	reply.Data["command"] = "onPublish"
+	reply.Data["id"] = msg.Id
+	reply.Data["seq"] = msg.Seq
+	reply.Data["delivered"] = req.Delivered
+	if req.AckIdentities {
+		reply.Data["identities"] = req.Identities
+	}
+
+	if err := req.Conn.Send(reply); err != nil {
+		Debugln("sendReceipt(): Failed to send onPublish reply:", err)
+	}
+}
+
+// Delivers a direct message to every connection of the
+// identity it is addressed to. If the identity went away
+// while the message was queued, the sender gets an error.
+func (sh *shard) sendDirect(req *DispatchReq) {
+	msg := req.Msg
+
+	sh.server.identsLock.RLock()
+	client, ok := sh.server.idents[msg.To]
+	sh.server.identsLock.RUnlock()
+
+	sender := sh.sender(req)
+	if ok {
+		req.Delivered = deliver(req, sender, client)
+	}
+
+	if req.Delivered > 0 && req.AckIdentities {
+		req.Identities = []string{msg.To}
+	}
+
+	// a message to its own identity with nowhere else to
+	// go isn't an error
+	if req.Delivered == 0 && req.Conn != nil && !(ok && client == sender) {
+		errMsg := NewErrorMessage(ErrIdentityOffline.Error())
+		errMsg.Channel = msg.Channel
+		errMsg.Data["to"] = msg.To
+		req.Conn.Send(errMsg)
+	}
+}
+
+// Adds the Client to the channel named in the subscribe
+// command msg and notifies the channel.
+func (sh *shard) subscribe(c Conn, client *Client, msg *message) error {
+
+	if msg.Channel == "" {
+		return errors.New("subscribe command has no channel")
+	}
+
+	if isPattern(msg.Channel) {
+		if err := validatePattern(msg.Channel); err != nil {
+			return err
+		}
+	}
+
+	exclude, hasExclude := excludeOption(msg)
+	if hasExclude && !validExclude(exclude) {
+		return ErrInvalidExclude
+	}
+
+	if !sh.server.channelAllowed(c, msg.Channel) {
+		return ErrChannelDenied
+	}
+
+	if err := sh.server.checkACL(c, client.Identity, ACL_SUBSCRIBE, msg.Channel); err != nil {
+		return err
+	}
+
+	members := sh.members(msg.Channel)
+
+	for _, clientTest := range members {
+		if clientTest == client {
+			// another connection of the identity joins
+			// the subscription, without a second onJoin.
+			// The exclude option is shared by the identity,
+			// so subscribing again changes it.
+			client.HoldChannel(msg.Channel, c)
+			if hasExclude {
+				client.SetExclude(msg.Channel, exclude)
+			}
+
+			// only the joining connection hears about it
+			reply := NewCommand()
+			reply.Channel = msg.Channel
+			reply.Identity = msg.Identity
+			reply.Data["command"] = "onSubscribe"
+			reply.Data["options"] = msg.Data["options"]
+			reply.Data["count"] = len(members)
+			sh.server.stamp(reply)
+			if err := c.Send(reply); err != nil {
+				Debugln("subscribe(): Failed to send onSubscribe:", err)
+			}
+			return ErrAlreadySubscribed
+		}
+	}
+
+	if !client.AddChannel(msg.Channel) {
+		return errors.New("client has disconnected")
+	}
+	client.HoldChannel(msg.Channel, c)
+
+	// pattern members can be read by other shards, so
+	// the slice is copied rather than appended in place
+	members = append(members[:len(members):len(members)], client)
+	sh.setMembers(msg.Channel, members)
+
+	if meta, ok := presenceOption(msg); ok {
+		client.SetPresence(msg.Channel, meta)
+	}
+	if hasExclude {
+		client.SetExclude(msg.Channel, exclude)
+	}
+
+	reply := NewCommand()
+	reply.Channel = msg.Channel
+	reply.Identity = msg.Identity
+	reply.Data["command"] = "onSubscribe"
+	reply.Data["options"] = msg.Data["options"]
+	reply.Data["count"] = len(members)
+
+	sh.sendReply(reply)
+	sh.server.notifyMonitor(reply)
+
+	// the Client group is only added to a channel once,
+	// no matter how many connections the identity has
+	if client.Identity != "" {
+		sh.sendReply(newPresenceEvent("onJoin", msg.Channel, client, len(members)))
+	}
+
+	Debugf("dispatchService(): subscribed %v => \"%v\"", client, msg.Channel)
+
+	return nil
+}
+
+// Removes the connection from the channel named in the
+// unsubscribe command msg. The Client only leaves, and the
+// channel is only notified, when it was the last connection
+// of the Client subscribed to the channel.
+func (sh *shard) unsubscribe(c Conn, client *Client, msg *message) error {
+
+	if msg.Channel == "" {
+		return errors.New("unsubscribe command has no channel")
+	}
+
+	members := sh.members(msg.Channel)
+
+	if held, left := client.ReleaseChannel(msg.Channel, c); left > 0 {
+		if !held {
+			return errors.New("connection was not subscribed to channel")
+		}
+
+		Debugf("dispatchService(): unsubscribing %v from %v. %d connections of %v remain",
+			c, msg.Channel, left, client.Identity)
+
+		reply := NewCommand()
+		reply.Identity = msg.Identity
+		reply.Channel = msg.Channel
+		reply.Data["command"] = "onUnsubscribe"
+		reply.Data["options"] = msg.Data["options"]
+		reply.Data["count"] = len(members)
+		sh.server.stamp(reply)
+		return c.Send(reply)
+	}
+
+	remaining := make([]*Client, 0, len(members))
+
+	for _, clientTest := range members {
+		if clientTest != client {
+			remaining = append(remaining, clientTest)
+		}
+	}
+
+	if len(remaining) == len(members) {
+		return errors.New("client was not subscribed to channel")
+	}
+
+	Debugf("dispatchService(): unsubscribing %v from %v", c, msg.Channel)
+
+	// the departing client still gets the replies
+	reply := NewCommand()
+	reply.Identity = msg.Identity
+	reply.Channel = msg.Channel
+	reply.Data["command"] = "onUnsubscribe"
+	reply.Data["options"] = msg.Data["options"]
+	reply.Data["count"] = len(remaining)
+
+	sh.setMembers(msg.Channel, remaining)
+
+	sh.sendReply(reply)
+	sh.server.notifyMonitor(reply)
+
+	if client.Identity != "" {
+		sh.sendReply(newPresenceEvent("onLeave", msg.Channel, client, len(remaining)))
+	}
+
+	client.RemoveChannel(msg.Channel)
+
+	return nil
+}
+
+// Replies to the connection with the identities currently
+// subscribed to the channel named in the presence command,
+// and their presence metadata.
+func (sh *shard) presence(c Conn, msg *message) error {
+
+	if msg.Channel == "" {
+		return errors.New("presence command has no channel")
+	}
+
+	members := sh.members(msg.Channel)
+
+	identities := []string{}
+	meta := map[string]interface{}{}
+	anonymous := 0
+
+	for _, client := range members {
+		if client.Identity == "" {
+			anonymous++
+			continue
+		}
+		identities = append(identities, client.Identity)
+		meta[client.Identity] = client.PresenceFor(msg.Channel)
+	}
+
+	reply := NewCommand()
+	reply.Channel = msg.Channel
+	reply.Identity = msg.Identity
+	reply.Data["command"] = "onPresence"
+	reply.Data["options"] = msg.Data["options"]
+	reply.Data["identities"] = identities
+	reply.Data["presence"] = meta
+	reply.Data["anonymous"] = anonymous
+	reply.Data["count"] = len(members)
+
+	return c.Send(reply)
+}
+
+// Adds a published message to its channel history
+func (sh *shard) recordHistory(msg *message) {
+	conf := currentConfig()
+	if conf.HISTORY_SIZE <= 0 || msg.Type != "message" {
+		return
+	}
+
+	// a reload only changes the size of new histories
+	h, ok := sh.history[msg.Channel]
+	if !ok {
+		h = NewHistory(conf.HISTORY_SIZE,
+			time.Duration(conf.HISTORY_MAX_AGE)*time.Second)
+		h.dropped = sh.swept
+		sh.history[msg.Channel] = h
+	}
+	h.Add(msg)
+}
+
+// Forgets the sequence and history of every channel with no
+// subscribers, exact or wildcard, and nothing left in its
+// history, so channels that come and go don't pile up. A
+// channel published to again starts its sequence over. A
+// history without a max age never empties, so its channel
+// is kept for good.
+func (sh *shard) sweepChannels() {
+	// a publisher holds the lock while it waits on a full
+	// queue, which only this goroutine drains
+	if !sh.publishLock.TryLock() {
+		return
+	}
+	defer sh.publishLock.Unlock()
+
+	for channel := range sh.sequences {
+		if sh.idle(channel) {
+			sh.forget(channel)
+		}
+	}
+	for channel := range sh.history {
+		if sh.idle(channel) {
+			sh.forget(channel)
+		}
+	}
+}
+
+func (sh *shard) forget(channel string) {
+	if h, ok := sh.history[channel]; ok && h.dropped > sh.swept {
+		sh.swept = h.dropped
+	}
+	delete(sh.history, channel)
+	delete(sh.sequences, channel)
+}
+
+// Returns true if a channel has no subscribers and
+// no history left
+func (sh *shard) idle(channel string) bool {
+	if len(sh.subs[channel]) > 0 {
+		return false
+	}
+	if h, ok := sh.history[channel]; ok && h.Len() > 0 {
+		return false
+	}
+
+	sh.server.patternsLock.RLock()
+	defer sh.server.patternsLock.RUnlock()
+
+	return len(sh.server.patterns.Match(channel)) == 0
+}
+
+// If the subscribe command asks for history, sends it to the
+// connection, followed by an onHistory command marking the
+// end of the replay.
+func (sh *shard) replayHistory(c Conn, msg *message) {
+	if currentConfig().HISTORY_SIZE <= 0 || isPattern(msg.Channel) {
+		return
+	}
+
+	n, since, ok := historyOptions(msg)
+	if !ok {
+		return
+	}
+
+	var msgs []*message
+	found := true
+
+	serial, valid := sh.server.parseMessageId(since)
+	if since != "" && !valid {
+		// an id from before a restart
+		found = false
+	}
+
+	if h, ok := sh.history[msg.Channel]; ok {
+		if since == "" {
+			msgs = h.Last(n)
+		} else if valid {
+			msgs, found = h.Since(serial)
+		} else {
+			msgs = h.Last(0)
+		}
+	} else if valid && serial < sh.swept {
+		// the channel's history may have been swept away
+		found = false
+	}
+
+	for _, m := range msgs {
+		if err := c.Send(m); err != nil && err != ErrMessageDropped {
+			Debugln("replayHistory(): Failed to send history:", err)
+			return
+		}
+	}
+
+	reply := NewCommand()
+	reply.Channel = msg.Channel
+	reply.Identity = msg.Identity
+	reply.Data["command"] = "onHistory"
+	reply.Data["options"] = msg.Data["options"]
+	reply.Data["count"] = len(msgs)
+
+	// the since id had already dropped out of the history,
+	// so some messages may have been missed
+	reply.Data["truncated"] = !found
+
+	if err := c.Send(reply); err != nil {
+		Debugln("replayHistory(): Failed to send onHistory reply:", err)
+	}
+}
+
+// Stamp a message with the next server-wide serial and its id
+func (s *ServerHandler) stamp(msg *message) {
+	msg.serial = atomic.AddUint64(&s.lastSerial, 1)
+	msg.Id = s.messageId(msg.serial)
+}
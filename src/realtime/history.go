@@ -0,0 +1,119 @@
+package main
+
+/*
+	History
+
+	A bounded ring buffer of the most recent messages
+	published to a channel, so that a client subscribing
+	late can ask for a replay of what it missed.
+*/
+
+import (
+	"time"
+)
+
+type History struct {
+	msgs   []*message
+	times  []time.Time
+	start  int
+	count  int
+	maxAge time.Duration
+
+	// serial of the newest message that has dropped out
+	dropped uint64
+}
+
+// Create a new History that holds at most size messages,
+// each for no longer than maxAge. A maxAge of 0 means
+// messages are only dropped once the buffer is full.
+func NewHistory(size int, maxAge time.Duration) *History {
+	return &History{
+		msgs:   make([]*message, size),
+		times:  make([]time.Time, size),
+		maxAge: maxAge,
+	}
+}
+
+// Add a message to the end of the buffer, pushing out
+// the oldest message if it is full
+func (h *History) Add(msg *message) {
+	size := len(h.msgs)
+	if size == 0 {
+		return
+	}
+
+	if h.count == size {
+		h.dropped = h.msgs[h.start].serial
+	}
+
+	idx := (h.start + h.count) % size
+	h.msgs[idx] = msg
+	h.times[idx] = time.Now()
+
+	if h.count < size {
+		h.count++
+	} else {
+		h.start = (h.start + 1) % size
+	}
+}
+
+// The number of messages currently held
+func (h *History) Len() int {
+	h.expire()
+	return h.count
+}
+
+// Returns up to the last n messages, oldest first.
+// n <= 0 returns everything held.
+func (h *History) Last(n int) []*message {
+	h.expire()
+
+	if n <= 0 || n > h.count {
+		n = h.count
+	}
+	return h.slice(h.count-n, h.count)
+}
+
+// Returns every message that was published after the message
+// with the given serial, oldest first. The serial does not have
+// to be from this channel, since they are ordered across the
+// server. If messages after it have already dropped out of the
+// buffer, found is false.
+func (h *History) Since(serial uint64) (msgs []*message, found bool) {
+	h.expire()
+
+	size := len(h.msgs)
+	from := h.count
+	for from > 0 && h.msgs[(h.start+from-1)%size].serial > serial {
+		from--
+	}
+	return h.slice(from, h.count), h.dropped <= serial
+}
+
+// Copies out the messages between the offsets from
+// the oldest message
+func (h *History) slice(from, to int) []*message {
+	size := len(h.msgs)
+	msgs := make([]*message, 0, to-from)
+	for i := from; i < to; i++ {
+		msgs = append(msgs, h.msgs[(h.start+i)%size])
+	}
+	return msgs
+}
+
+// Drops any messages from the front of the buffer that
+// are older than maxAge
+func (h *History) expire() {
+	if h.maxAge <= 0 {
+		return
+	}
+
+	size := len(h.msgs)
+	oldest := time.Now().Add(-h.maxAge)
+	for h.count > 0 && h.times[h.start].Before(oldest) {
+		h.dropped = h.msgs[h.start].serial
+		h.msgs[h.start] = nil
+		h.start = (h.start + 1) % size
+		h.count--
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newHistoryMsg(id int) *message {
+	msg := NewMessage()
+	msg.serial = uint64(id)
+	msg.Id = strconv.Itoa(id)
+	return msg
+}
+
+// TestHistory
+// Fills a History past its size and checks that only the
+// most recent messages are replayed, in order.
+func TestHistory(t *testing.T) {
+
+	h := NewHistory(5, 0)
+	for i := 1; i <= 8; i++ {
+		h.Add(newHistoryMsg(i))
+	}
+
+	if h.Len() != 5 {
+		t.Fatalf("Expected 5 messages in history but got %d", h.Len())
+	}
+
+	msgs := h.Last(3)
+	if len(msgs) != 3 || msgs[0].Id != "6" || msgs[2].Id != "8" {
+		t.Fatalf("Expected the last 3 messages (6-8) but got %v", msgs)
+	}
+
+	msgs, found := h.Since(5)
+	if !found || len(msgs) != 3 || msgs[0].Id != "6" {
+		t.Fatalf("Expected messages 6-8 since serial 5 but got %v (found: %v)", msgs, found)
+	}
+
+	msgs, found = h.Since(2)
+	if found || len(msgs) != 5 || msgs[0].Id != "4" {
+		t.Fatalf("Expected all held messages for an expired serial but got %v (found: %v)", msgs, found)
+	}
+
+	if msgs, found = h.Since(3); !found || len(msgs) != 5 {
+		t.Fatalf("Expected all held messages since the last dropped serial but got %v (found: %v)", msgs, found)
+	}
+
+	if msgs, found = h.Since(8); !found || len(msgs) != 0 {
+		t.Fatalf("Expected no messages since the latest serial but got %v", msgs)
+	}
+}
+
+// TestHistoryMaxAge
+// Checks that messages older than the max age are dropped
+func TestHistoryMaxAge(t *testing.T) {
+
+	h := NewHistory(5, 50*time.Millisecond)
+	h.Add(newHistoryMsg(1))
+	time.Sleep(100 * time.Millisecond)
+	h.Add(newHistoryMsg(2))
+
+	msgs := h.Last(0)
+	if len(msgs) != 1 || msgs[0].Id != "2" {
+		t.Fatalf("Expected only message 2 to remain but got %v", msgs)
+	}
+}
+
+// TestSweepChannels
+// Publishes to channels with and without subscribers, and
+// checks only the ones no one uses are forgotten once their
+// history has expired
+func TestSweepChannels(t *testing.T) {
+
+	setTestConfig(t, func(conf *Config) {
+		conf.DISPATCH_SHARDS = 1
+		conf.OUTBOUND_QUEUE = 0
+		conf.HISTORY_SIZE = 5
+		conf.HISTORY_MAX_AGE = 1
+	})
+
+	server := NewServerHandler(nil)
+	defer server.Shutdown()
+	sh := server.shards[0]
+
+	bob := newRecordConn("bob")
+	server.OnRawMessage(bob, []byte(`{"type":"command","identity":"bob","data":{"command":"init","channels":["kept","news.*"]}}`))
+	defer server.OnDisconnect(bob)
+
+	publish := func(channel string) *message {
+		msg := NewMessage()
+		msg.Channel = channel
+		msg.Data["text"] = "hi"
+		if err := server.publish(nil, msg); err != nil {
+			t.Fatal("publish:", err)
+		}
+		return msg
+	}
+	first := publish("gone")
+	publish("gone")
+	publish("kept")
+	publish("news.eu")
+	server.flushMessages()
+
+	// nothing has expired yet
+	sh.sweepChannels()
+	if len(sh.sequences) != 3 || len(sh.history) != 3 {
+		t.Fatalf("Expected every channel to be kept but got %v", sh.sequences)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	sh.sweepChannels()
+	if _, ok := sh.sequences["gone"]; ok || len(sh.sequences) != 2 || len(sh.history) != 2 {
+		t.Fatalf("Expected only the unused channel to be forgotten but got %v", sh.sequences)
+	}
+
+	if msg := publish("gone"); msg.Seq != 1 {
+		t.Fatalf("Expected a forgotten channel to start its sequence over but got %v", msg.Seq)
+	}
+	server.flushMessages()
+
+	server.OnRawMessage(bob, []byte(`{"type":"command","identity":"bob","channel":"gone","data":{"command":"subscribe","options":{"since":"`+first.Id+`"}}}`))
+	// the message after the first went with the history
+	msg := bob.until(t, func(msg *message) bool { return msg.Data["command"] == "onHistory" })
+	if msg.Data["truncated"] != true || msg.Data["count"] != 1 {
+		t.Fatalf("Expected a truncated replay of the one message left but got %+v", msg.Data)
+	}
+}
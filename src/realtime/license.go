@@ -0,0 +1,587 @@
+package main
+
+/*
+	License
+
+	Clients are only accepted from licensed domains. Licenses are
+	kept one per line in license.txt, and are either a key, which
+	is sha1(domain + secret), or a signed token that can also carry
+	an expiry date and a connection limit:
+
+		rt1.<base64 json payload>.<base64 hmac-sha256 signature>
+
+	A license for a domain takes one of three forms:
+
+		example.com        the registrable domain, and all its subdomains
+		app.example.com    only that host
+		*.app.example.com  the subdomains of app.example.com
+
+	The registrable domain comes from the public suffix list, so
+	foo.co.uk and evil.co.uk are different domains.
+
+	The license subcommand manages keys and tokens:
+
+		realtime license generate DOMAIN...
+		realtime license token [-expires DATE] [-max-connections N] DOMAIN...
+		realtime license list [DOMAIN...]
+		realtime license validate DOMAIN...
+		realtime license origin ORIGIN...
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+var (
+	// The secret used before it could be configured. Keys made
+	// with it keep working unless another secret is set.
+	PADDING = []byte("Rk8ohYJQBXopu82XmVTFsAgG3r4f")
+
+	licenseKeyFormat = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+	ErrTokenFormat    = errors.New("license token is malformed")
+	ErrTokenSignature = errors.New("license token signature does not match the license secret")
+	ErrNoLicense      = errors.New("Unable to find/read any valid licenses")
+)
+
+const (
+	LOCALHOST = `localhost`
+
+	// overrides the secret in the config file
+	LICENSE_SECRET_ENV = "REALTIME_LICENSE_SECRET"
+
+	LICENSE_TOKEN_PREFIX = "rt1."
+
+	// tokens expiring within this long are warned about
+	LICENSE_EXPIRY_WARNING = 30 * 24 * time.Hour
+
+	// how often the tokens are checked for expiry
+	LICENSE_CHECK_INTERVAL = 24 * time.Hour
+)
+
+type License []string
+
+// Looks for a license.txt file in either the current
+// directory, an etc subdir, or an etc directory one up
+// from the current directory
+// Returns a new License object, populated with the parsed
+// license keys
+func NewLicense() (license License, err error) {
+	lic := "license.txt"
+
+	p1 := filepath.Join(ROOT, lic)
+
+	parent, _ := filepath.Split(ROOT)
+	p2 := filepath.Join(parent, "etc", lic)
+
+	p3 := filepath.Join(ROOT, "etc", lic)
+
+	var (
+		reader *bufio.Reader
+		line   []byte
+		prefix bool
+		fh     *os.File
+		buffer bytes.Buffer
+	)
+
+	for _, p := range []string{p1, p2, p3} {
+		if fileExists(p) {
+			fh, err = os.Open(p)
+			if err != nil {
+				continue
+			}
+
+			reader = bufio.NewReaderSize(fh, 50)
+
+			buffer.Reset()
+
+			for {
+				line, prefix, err = reader.ReadLine()
+				if err != nil {
+					err = nil
+					break
+				}
+				if len(line) == 0 || bytes.IndexAny(line, "#/;") > -1 {
+					continue
+				}
+
+				buffer.WriteString(string(line))
+				if prefix {
+					continue
+				}
+
+				license = append(license, string(buffer.Bytes()))
+				buffer.Reset()
+			}
+
+			fh.Close()
+		}
+	}
+	if len(license) == 0 {
+		err = ErrNoLicense
+	}
+	return license, err
+
+}
+
+// Matches a given license string against the licenses
+// in the current configuration, and return true if its valid.
+func (l License) IsValid(lic string) bool {
+	buf := new(bytes.Buffer)
+	for _, val := range l {
+		buf.WriteString("License test failures: " + val + " != " + lic + "\n")
+		if val == lic {
+			return true
+		}
+	}
+	Debugln(buf.String())
+	return false
+}
+
+func (l License) CheckHttpRequest(req *http.Request) bool {
+	var (
+		origin, host string
+	)
+
+	origin = req.Header.Get("Origin")
+	if origin == "" {
+		origin = req.Header.Get("Sec-Websocket-Origin")
+	}
+
+	origin = normalizeOrigin(origin)
+
+	host = strings.SplitN(req.Host, ":", 2)[0]
+
+	// localhost connections to a local server are always allowed
+	if host == LOCALHOST && (origin == "" || origin == LOCALHOST) {
+		return true
+	} else if origin == "" {
+		origin = host
+	}
+
+	if len(l) == 0 {
+		return false
+	}
+
+	name, passed := l.Match(origin, currentConfig().LICENSE_SECRET, time.Now())
+	if passed {
+		Debugf("origin: %v, licensed as %v\n", origin, name)
+	} else {
+		Debugf("host: %v, origin: %v\n", host, origin)
+	}
+	return passed
+
+}
+
+// Reduces an Origin header to the host that is licensed: the
+// lowercased host without its port. An origin that isn't a URL
+// is returned as it is.
+func normalizeOrigin(origin string) string {
+	if origin == "" {
+		return origin
+	}
+
+	url_, err := url.Parse(origin)
+	if err != nil || url_.Host == "" {
+		return origin
+	}
+
+	return strings.ToLower(url_.Hostname())
+}
+
+// Returns the registrable domain of a host, which is one label
+// more than its public suffix: www.example.co.uk is example.co.uk.
+// IPs, single labels and public suffixes are returned as they are.
+func registrableDomain(host string) string {
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	domain, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return host
+	}
+	return domain
+}
+
+// Returns the license names that cover a host, most specific
+// first: the host itself, the wildcards for each parent domain
+// up to the registrable domain, then the registrable domain.
+//
+//	a.b.example.com => a.b.example.com, *.b.example.com, *.example.com, example.com
+func licenseNames(host string) []string {
+	if host == "" {
+		return nil
+	}
+
+	names := []string{host}
+
+	domain := registrableDomain(host)
+	if domain == host {
+		return names
+	}
+
+	for parent := host; parent != domain; {
+		parent = parent[strings.Index(parent, ".")+1:]
+		names = append(names, "*."+parent)
+	}
+	return append(names, domain)
+}
+
+// Returns the license key for a domain
+func licenseKey(domain, secret string) string {
+	hash := sha1.New()
+	hash.Write([]byte(domain))
+	hash.Write([]byte(secret))
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
+
+// The payload of a signed license token
+type LicenseToken struct {
+	Domains []string  `json:"domains"`
+	Expires time.Time `json:"expires"`
+
+	// concurrent connections allowed, 0 for no limit
+	MaxConnections int `json:"max_connections,omitempty"`
+}
+
+// Signs the token with the secret, and returns it in the form
+// it takes in license.txt
+func (t *LicenseToken) Sign(secret string) (string, error) {
+	payload, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+	signed := LICENSE_TOKEN_PREFIX + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + tokenSignature(signed, secret), nil
+}
+
+// Returns true if the token licenses the domain
+func (t *LicenseToken) Covers(domain string) bool {
+	for _, d := range t.Domains {
+		if d == domain {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *LicenseToken) Expired(now time.Time) bool {
+	return !now.Before(t.Expires)
+}
+
+func (t *LicenseToken) String() string {
+	s := fmt.Sprintf("%v, expires %v", strings.Join(t.Domains, ","), t.Expires.Format("2006-01-02"))
+	if t.MaxConnections > 0 {
+		s += fmt.Sprintf(", max %d connections", t.MaxConnections)
+	}
+	return s
+}
+
+func tokenSignature(signed, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func isLicenseToken(lic string) bool {
+	return strings.HasPrefix(lic, LICENSE_TOKEN_PREFIX)
+}
+
+// Verifies a token against the secret and returns its payload.
+// An expired token is still returned; check Expired.
+func parseLicenseToken(lic, secret string) (*LicenseToken, error) {
+	if !isLicenseToken(lic) {
+		return nil, ErrTokenFormat
+	}
+
+	i := strings.LastIndex(lic, ".")
+	if i < len(LICENSE_TOKEN_PREFIX) {
+		return nil, ErrTokenFormat
+	}
+	signed, sig := lic[:i], lic[i+1:]
+
+	if !hmac.Equal([]byte(sig), []byte(tokenSignature(signed, secret))) {
+		return nil, ErrTokenSignature
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(signed[len(LICENSE_TOKEN_PREFIX):])
+	if err != nil {
+		return nil, ErrTokenFormat
+	}
+
+	token := new(LicenseToken)
+	if err = json.Unmarshal(payload, token); err != nil || len(token.Domains) == 0 || token.Expires.IsZero() {
+		return nil, ErrTokenFormat
+	}
+	return token, nil
+}
+
+// Returns the tokens in the license that are signed with the
+// secret. Anything else is skipped.
+func (l License) Tokens(secret string) []*LicenseToken {
+	var tokens []*LicenseToken
+	for _, lic := range l {
+		if !isLicenseToken(lic) {
+			continue
+		}
+		if token, err := parseLicenseToken(lic, secret); err == nil {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// Returns true if the host has a license key, or an unexpired
+// token, for any of its license names
+func (l License) Allows(host, secret string, now time.Time) bool {
+	_, ok := l.Match(host, secret, now)
+	return ok
+}
+
+// Returns the license name the host is licensed as, and true,
+// or false if it isn't licensed
+func (l License) Match(host, secret string, now time.Time) (string, bool) {
+	names := licenseNames(host)
+
+	for _, name := range names {
+		if l.IsValid(licenseKey(name, secret)) {
+			return name, true
+		}
+	}
+
+	for _, token := range l.Tokens(secret) {
+		if token.Expired(now) {
+			continue
+		}
+		for _, name := range names {
+			if token.Covers(name) {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Returns the most connections the license allows at once, or 0
+// for no limit. The limits of the unexpired tokens add up, but
+// a license key or a token without a limit lifts it entirely.
+func (l License) MaxConnections(secret string, now time.Time) int {
+	max := 0
+	for _, lic := range l {
+		if !isLicenseToken(lic) {
+			if licenseKeyFormat.MatchString(lic) {
+				return 0
+			}
+			continue
+		}
+
+		token, err := parseLicenseToken(lic, secret)
+		if err != nil || token.Expired(now) {
+			continue
+		}
+		if token.MaxConnections == 0 {
+			return 0
+		}
+		max += token.MaxConnections
+	}
+	return max
+}
+
+// Describes the tokens that are invalid, have expired, or
+// expire within LICENSE_EXPIRY_WARNING
+func (l License) Warnings(secret string, now time.Time) []string {
+	var warnings []string
+	for _, lic := range l {
+		if !isLicenseToken(lic) {
+			continue
+		}
+
+		token, err := parseLicenseToken(lic, secret)
+		switch {
+		case err != nil:
+			warnings = append(warnings, fmt.Sprintf("Ignoring a license token: %v", err))
+		case token.Expired(now):
+			warnings = append(warnings, fmt.Sprintf("License for %v has expired", token))
+		case token.Expires.Sub(now) < LICENSE_EXPIRY_WARNING:
+			days := int(token.Expires.Sub(now).Hours() / 24)
+			warnings = append(warnings, fmt.Sprintf("License for %v (%d days left)", token, days))
+		}
+	}
+	return warnings
+}
+
+// Logs the license warnings for the current config
+func checkLicense() {
+	for _, warning := range currentLicense().Warnings(currentConfig().LICENSE_SECRET, time.Now()) {
+		log.Println("[WARN]", warning)
+	}
+}
+
+// Runs the license subcommand, writing its output to out.
+// Returns the exit status.
+func licenseCmd(args []string, out io.Writer) int {
+	usage := func() int {
+		fmt.Fprintln(out, "Usage:")
+		fmt.Fprintln(out, "  realtime license generate DOMAIN...  print the license key for each domain")
+		fmt.Fprintln(out, "  realtime license token [-expires DATE] [-max-connections N] DOMAIN...")
+		fmt.Fprintln(out, "                                       print a signed token licensing the domains")
+		fmt.Fprintln(out, "  realtime license list [DOMAIN...]    list the keys in license.txt, and which of the domains they license")
+		fmt.Fprintln(out, "  realtime license validate DOMAIN...  check each domain has a key in license.txt")
+		fmt.Fprintln(out, "  realtime license origin ORIGIN...    show the host each Origin header is checked as, and its license")
+		return 2
+	}
+
+	if len(args) == 0 {
+		return usage()
+	}
+
+	secret := currentConfig().LICENSE_SECRET
+	cmd, args := args[0], args[1:]
+
+	lower := func(domains []string) []string {
+		for i := range domains {
+			domains[i] = strings.ToLower(domains[i])
+		}
+		return domains
+	}
+
+	switch cmd {
+
+	case "generate":
+		if len(args) == 0 {
+			return usage()
+		}
+		for _, domain := range lower(args) {
+			fmt.Fprintf(out, "%v  %v\n", licenseKey(domain, secret), domain)
+		}
+
+	case "token":
+		flags := flag.NewFlagSet("license token", flag.ContinueOnError)
+		flags.SetOutput(out)
+		expires := flags.String("expires", time.Now().AddDate(1, 0, 0).Format("2006-01-02"), "the date the token expires (YYYY-MM-DD)")
+		maxConns := flags.Int("max-connections", 0, "concurrent connections allowed (0 for no limit)")
+		if err := flags.Parse(args); err != nil || flags.NArg() == 0 {
+			return usage()
+		}
+
+		token := &LicenseToken{
+			Domains:        lower(flags.Args()),
+			MaxConnections: *maxConns,
+		}
+
+		var err error
+		if token.Expires, err = time.Parse("2006-01-02", *expires); err != nil {
+			fmt.Fprintln(out, "Invalid -expires date:", err)
+			return 2
+		}
+
+		signed, err := token.Sign(secret)
+		if err != nil {
+			fmt.Fprintln(out, err)
+			return 1
+		}
+		fmt.Fprintln(out, signed)
+
+	case "list":
+		license, err := NewLicense()
+		if err != nil {
+			fmt.Fprintln(out, err)
+			return 1
+		}
+
+		domains := make(map[string]string, len(args))
+		for _, domain := range lower(args) {
+			domains[licenseKey(domain, secret)] = domain
+		}
+
+		status := 0
+		for _, key := range license {
+			if isLicenseToken(key) {
+				token, err := parseLicenseToken(key, secret)
+				switch {
+				case err != nil:
+					fmt.Fprintf(out, "%v  (%v)\n", key, err)
+					status = 1
+				case token.Expired(time.Now()):
+					fmt.Fprintf(out, "%v  %v (expired)\n", key, token)
+				default:
+					fmt.Fprintf(out, "%v  %v\n", key, token)
+				}
+				continue
+			}
+
+			switch {
+			case !licenseKeyFormat.MatchString(key):
+				fmt.Fprintf(out, "%v  (not a valid key)\n", key)
+				status = 1
+			case domains[key] != "":
+				fmt.Fprintf(out, "%v  %v\n", key, domains[key])
+			default:
+				fmt.Fprintln(out, key)
+			}
+		}
+		return status
+
+	case "validate":
+		if len(args) == 0 {
+			return usage()
+		}
+
+		license, _ := NewLicense()
+
+		status := 0
+		for _, domain := range lower(args) {
+			if license.Allows(domain, secret, time.Now()) {
+				fmt.Fprintf(out, "%v  licensed\n", domain)
+			} else {
+				fmt.Fprintf(out, "%v  NOT licensed\n", domain)
+				status = 1
+			}
+		}
+		return status
+
+	case "origin":
+		if len(args) == 0 {
+			return usage()
+		}
+
+		license, _ := NewLicense()
+
+		for _, origin := range args {
+			host := normalizeOrigin(origin)
+			licensed := "NOT licensed"
+			if host == LOCALHOST {
+				licensed = "allowed on a localhost server"
+			} else if name, ok := license.Match(host, secret, time.Now()); ok {
+				licensed = "licensed as " + name
+			}
+			fmt.Fprintf(out, "%v  =>  %v  (%v)\n", origin, host, licensed)
+		}
+
+	default:
+		return usage()
+	}
+
+	return 0
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLicenseKey(t *testing.T) {
+	// the example from the README, made with the built-in secret
+	key := licenseKey("mydomain.com", string(PADDING))
+	if key != "571ab3357c3e56e20b764f25e62149229f5d4b08" {
+		t.Fatalf("Expected the key from the README but got %v", key)
+	}
+
+	if licenseKey("mydomain.com", "another secret") == key {
+		t.Fatal("Expected a different secret to give a different key")
+	}
+}
+
+func TestNormalizeOrigin(t *testing.T) {
+	tests := []struct {
+		origin, domain string
+	}{
+		{"", ""},
+		{"http://mydomain.com", "mydomain.com"},
+		{"https://www.mydomain.com:8080", "www.mydomain.com"},
+		{"http://a.b.MyDomain.com", "a.b.mydomain.com"},
+		{"http://192.168.1.10:8001", "192.168.1.10"},
+		{"http://[::1]:8001", "::1"},
+		{"http://localhost:8001", "localhost"},
+		{"mydomain.com", "mydomain.com"},
+	}
+
+	for _, test := range tests {
+		if domain := normalizeOrigin(test.origin); domain != test.domain {
+			t.Errorf("Expected %q to normalize to %q but got %q", test.origin, test.domain, domain)
+		}
+	}
+}
+
+func TestLicenseNames(t *testing.T) {
+	tests := []struct {
+		host  string
+		names []string
+	}{
+		{"example.com", []string{"example.com"}},
+		{"app.example.com", []string{"app.example.com", "*.example.com", "example.com"}},
+		{"a.b.example.com", []string{"a.b.example.com", "*.b.example.com", "*.example.com", "example.com"}},
+		{"www.foo.co.uk", []string{"www.foo.co.uk", "*.foo.co.uk", "foo.co.uk"}},
+		{"co.uk", []string{"co.uk"}},
+		{"192.168.1.10", []string{"192.168.1.10"}},
+		{"localhost", []string{"localhost"}},
+	}
+
+	for _, test := range tests {
+		if names := licenseNames(test.host); strings.Join(names, " ") != strings.Join(test.names, " ") {
+			t.Errorf("Expected %q to be licensed by %v but got %v", test.host, test.names, names)
+		}
+	}
+}
+
+// TestLicenseOrigins
+// Checks which origins a license file with each form of entry
+// lets in, as keys and as tokens
+func TestLicenseOrigins(t *testing.T) {
+	const secret = "test secret"
+
+	entries := []string{"mydomain.com", "foo.co.uk", "app.example.com", "*.api.example.com", "192.168.1.10"}
+
+	keys := make(License, len(entries))
+	for i, entry := range entries {
+		keys[i] = licenseKey(entry, secret)
+	}
+	token, _ := (&LicenseToken{Domains: entries, Expires: time.Now().AddDate(1, 0, 0)}).Sign(secret)
+
+	tests := []struct {
+		origin   string
+		licensed bool
+	}{
+		{"http://mydomain.com", true},
+		{"https://www.mydomain.com:8080", true},
+		{"http://a.b.mydomain.com", true},
+		{"http://notmydomain.com", false},
+		{"http://mydomain.com.evil.com", false},
+
+		{"https://foo.co.uk", true},
+		{"https://www.foo.co.uk", true},
+		{"https://evil.co.uk", false},
+		{"https://co.uk", false},
+
+		{"https://app.example.com", true},
+		{"https://App.Example.com:443", true},
+		{"https://example.com", false},
+		{"https://other.example.com", false},
+		{"https://x.app.example.com", false},
+
+		{"https://v1.api.example.com", true},
+		{"https://a.v1.api.example.com", true},
+		{"https://api.example.com", false},
+
+		{"http://192.168.1.10:8001", true},
+		{"http://192.168.1.11", false},
+		{"", false},
+	}
+
+	for _, license := range []License{keys, {token}} {
+		for _, test := range tests {
+			host := normalizeOrigin(test.origin)
+			if licensed := license.Allows(host, secret, time.Now()); licensed != test.licensed {
+				t.Errorf("Expected %q (%v) to be licensed=%v with %.3s entries", test.origin, host, test.licensed, license[0])
+			}
+		}
+	}
+}
+
+// TestLicenseCmd
+// Generates a key with a configured secret, and checks a
+// license file holding it validates the domain
+func TestLicenseCmd(t *testing.T) {
+
+	defer func(root string) { ROOT = root }(ROOT)
+
+	ROOT = t.TempDir()
+	setTestConfig(t, func(conf *Config) { conf.LICENSE_SECRET = "test secret" })
+
+	var out bytes.Buffer
+	if status := licenseCmd([]string{"generate", "mydomain.com"}, &out); status != 0 {
+		t.Fatalf("Expected generate to succeed but got status %d: %v", status, out.String())
+	}
+	key := strings.Fields(out.String())[0]
+	if key != licenseKey("mydomain.com", "test secret") {
+		t.Fatalf("Expected the key made with the configured secret but got %v", out.String())
+	}
+
+	writeTestFile(t, ROOT, "license.txt", "# keys\n"+key+"\nnot-a-key\n")
+
+	out.Reset()
+	if status := licenseCmd([]string{"list", "mydomain.com"}, &out); status != 1 {
+		t.Fatalf("Expected list to fail on the invalid key but got status %d", status)
+	}
+	if !strings.Contains(out.String(), key+"  mydomain.com") || !strings.Contains(out.String(), "not-a-key  (not a valid key)") {
+		t.Fatalf("Expected the key listed with its domain, and the invalid key, but got %v", out.String())
+	}
+
+	out.Reset()
+	if status := licenseCmd([]string{"validate", "mydomain.com", "other.com"}, &out); status != 1 {
+		t.Fatalf("Expected validate to fail for other.com but got status %d", status)
+	}
+	if !strings.Contains(out.String(), "mydomain.com  licensed") || !strings.Contains(out.String(), "other.com  NOT licensed") {
+		t.Fatalf("Expected only mydomain.com to be licensed but got %v", out.String())
+	}
+
+	out.Reset()
+	licenseCmd([]string{"origin", "https://app.mydomain.com:443"}, &out)
+	if !strings.Contains(out.String(), "=>  app.mydomain.com  (licensed as mydomain.com)") {
+		t.Fatalf("Expected the origin to normalize to a licensed mydomain.com but got %v", out.String())
+	}
+
+	out.Reset()
+	if status := licenseCmd([]string{"token", "-expires", "2099-01-01", "-max-connections", "10", "other.com"}, &out); status != 0 {
+		t.Fatalf("Expected token to succeed but got status %d: %v", status, out.String())
+	}
+	writeTestFile(t, ROOT, "license.txt", key+"\n"+out.String())
+
+	out.Reset()
+	if status := licenseCmd([]string{"validate", "mydomain.com", "other.com"}, &out); status != 0 {
+		t.Fatalf("Expected the token to license other.com but got %v", out.String())
+	}
+
+	out.Reset()
+	licenseCmd([]string{"list"}, &out)
+	if !strings.Contains(out.String(), "other.com, expires 2099-01-01, max 10 connections") {
+		t.Fatalf("Expected the token listed with its payload but got %v", out.String())
+	}
+
+	if status := licenseCmd([]string{"bogus"}, &out); status != 2 {
+		t.Fatalf("Expected usage for an unknown command but got status %d", status)
+	}
+}
+
+func TestLicenseToken(t *testing.T) {
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	sign := func(token *LicenseToken) string {
+		signed, err := token.Sign("test secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	current := sign(&LicenseToken{Domains: []string{"a.com", "b.com"}, Expires: now.AddDate(1, 0, 0), MaxConnections: 10})
+	expiring := sign(&LicenseToken{Domains: []string{"c.com"}, Expires: now.AddDate(0, 0, 10), MaxConnections: 5})
+	expired := sign(&LicenseToken{Domains: []string{"d.com"}, Expires: now.AddDate(0, 0, -1)})
+
+	token, err := parseLicenseToken(current, "test secret")
+	if err != nil || !token.Covers("b.com") || token.MaxConnections != 10 {
+		t.Fatalf("Expected the token to parse back but got %+v, %v", token, err)
+	}
+	if _, err = parseLicenseToken(current, "another secret"); err != ErrTokenSignature {
+		t.Fatalf("Expected a signature error with another secret but got %v", err)
+	}
+	if _, err = parseLicenseToken(strings.Replace(current, "rt1.e", "rt1.f", 1), "test secret"); err != ErrTokenSignature {
+		t.Fatalf("Expected a signature error for a changed payload but got %v", err)
+	}
+	if _, err = parseLicenseToken("rt1.nope", "test secret"); err != ErrTokenFormat {
+		t.Fatalf("Expected a format error but got %v", err)
+	}
+
+	license := License{current, expiring, expired, "rt1.bogus.token"}
+
+	for domain, allowed := range map[string]bool{"a.com": true, "c.com": true, "d.com": false, "e.com": false} {
+		if license.Allows(domain, "test secret", now) != allowed {
+			t.Errorf("Expected %v to be allowed=%v", domain, allowed)
+		}
+	}
+	if license.Allows("a.com", "another secret", now) {
+		t.Error("Expected tokens signed with another secret to be ignored")
+	}
+
+	if max := license.MaxConnections("test secret", now); max != 15 {
+		t.Errorf("Expected the unexpired limits to add up to 15 but got %d", max)
+	}
+	if max := append(license, licenseKey("e.com", "test secret")).MaxConnections("test secret", now); max != 0 {
+		t.Errorf("Expected a license key to lift the limit but got %d", max)
+	}
+
+	warnings := license.Warnings("test secret", now)
+	if len(warnings) != 3 ||
+		!strings.Contains(warnings[0], "c.com") || !strings.Contains(warnings[0], "10 days left") ||
+		!strings.Contains(warnings[1], "d.com") || !strings.Contains(warnings[1], "expired") ||
+		!strings.HasPrefix(warnings[2], "Ignoring a license token") {
+		t.Fatalf("Expected warnings for the expiring, expired and bogus tokens but got %v", warnings)
+	}
+}
+
+// TestConnectionLimit
+// Inits more connections than the license allows, and checks
+// the extra one is refused and the rest are left alone
+func TestConnectionLimit(t *testing.T) {
+
+	token, _ := (&LicenseToken{Domains: []string{"a.com"}, Expires: time.Now().AddDate(1, 0, 0), MaxConnections: 2}).Sign("test secret")
+	setTestConfig(t, func(conf *Config) {
+		conf.LICENSE_SECRET = "test secret"
+		LICENSE = License{token}
+	})
+
+	server := NewServerHandler(nil)
+	defer server.Shutdown()
+
+	conns := make([]*benchConn, 3)
+	for i := range conns {
+		conns[i] = &benchConn{id: fmt.Sprintf("limit-%d", i)}
+
+		msg := NewCommand()
+		msg.Data["command"] = "init"
+		server.initCmd(NewDispatchReq(conns[i], msg, false))
+	}
+
+	server.clientsLock.RLock()
+	defer server.clientsLock.RUnlock()
+
+	if len(server.clients) != 2 {
+		t.Fatalf("Expected only 2 connections to be accepted but got %d", len(server.clients))
+	}
+	if _, ok := server.clients["limit-2"]; ok {
+		t.Fatal("Expected the connection over the limit to be refused")
+	}
+	if conns[2].received != 1 {
+		t.Fatalf("Expected the refused connection to get an error but it got %d messages", conns[2].received)
+	}
+}
@@ -21,21 +21,35 @@ const (
 )
 
 type message struct {
+	Id        string                 `json:"id"`
+	Seq       uint64                 `json:"seq,omitempty"` // per-channel sequence
 	Type      string                 `json:"type"`
 	Channel   string                 `json:"channel"`
 	Success   bool                   `json:"success"`
 	Error     string                 `json:"error"`
 	Identity  string                 `json:"identity"`
+	To        string                 `json:"to,omitempty"` // direct message to an identity
 	Timestamp string                 `json:"timestamp"`
-	Data      map[string]interface{} `json:"data"` // client-side specific
+	EpochMs   int64                  `json:"timestamp_ms"` // milliseconds since the unix epoch
+	Data      map[string]interface{} `json:"data"`         // client-side specific
+
+	// publisher asks for an onPublish delivery receipt
+	Ack           bool `json:"ack,omitempty"`
+	AckIdentities bool `json:"ack_identities,omitempty"`
 
-	raw   string
-	mtype int
+	// publisher asks not to be sent its own message
+	// (connection or identity), or to be sent it despite
+	// its subscription options (none)
+	Exclude string `json:"exclude,omitempty"`
+
+	raw    string
+	mtype  int
+	serial uint64 // server-wide publish order, for history
 }
 
 func (m *message) String() string {
-	return fmt.Sprintf("message{Type: %v, Channel: \"%v\", Error: \"%v\", Identity: %v, raw: \"%v\"}",
-		m.Type, m.Channel, m.Error, m.Identity, m.raw)
+	return fmt.Sprintf("message{Type: %v, Channel: \"%v\", Error: \"%v\", Identity: %v, To: %v, raw: \"%v\"}",
+		m.Type, m.Channel, m.Error, m.Identity, m.To, m.raw)
 }
 
 func (m *message) setRaw(data string) {
@@ -46,21 +60,39 @@ func (m *message) getRaw() string {
 	return m.raw
 }
 
+// Returns the current time formatted for a message, along
+// with the milliseconds since the epoch. Timestamps are RFC 3339
+// with nanoseconds, unless the legacy format is configured for
+// older clients.
+func timestamp() (string, int64) {
+	now := time.Now().UTC()
+	ms := now.UnixNano() / int64(time.Millisecond)
+
+	if currentConfig().LEGACY_TIMESTAMPS {
+		return now.String(), ms
+	}
+	return now.Format(time.RFC3339Nano), ms
+}
+
 func NewCommand() *message {
+	ts, ms := timestamp()
 	return &message{
 		Type:      "command",
 		Success:   true,
-		Timestamp: time.Now().UTC().String(),
+		Timestamp: ts,
+		EpochMs:   ms,
 		Data:      map[string]interface{}{},
 		mtype:     CommandType,
 	}
 }
 
 func NewMessage() *message {
+	ts, ms := timestamp()
 	return &message{
 		Type:      "message",
 		Success:   true,
-		Timestamp: time.Now().UTC().String(),
+		Timestamp: ts,
+		EpochMs:   ms,
 		Data:      map[string]interface{}{},
 		mtype:     MessageType,
 	}
@@ -88,12 +120,15 @@ type monitorMessage struct {
 	Channels  []string               `json:"channels"`
 	Identity  string                 `json:"identity"`
 	Timestamp string                 `json:"timestamp"`
+	EpochMs   int64                  `json:"timestamp_ms"`
 	Data      map[string]interface{} `json:"data"` // client-side specific
 }
 
 func NewMonitorMessage() *monitorMessage {
+	ts, ms := timestamp()
 	return &monitorMessage{
-		Timestamp: time.Now().UTC().String(),
+		Timestamp: ts,
+		EpochMs:   ms,
 		Data:      map[string]interface{}{},
 	}
 }
@@ -0,0 +1,239 @@
+package main
+
+/*
+	Patterns
+
+	Channel names are made of segments separated by '.' or '/'.
+	A subscription can use wildcard segments:
+		*        matches exactly one segment
+		# or **  matches any number of remaining segments,
+		         and may only be the last segment
+
+	Wildcard subscriptions are indexed in a trie, so matching
+	a published channel only walks the branches that can match,
+	rather than testing every pattern.
+*/
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	WILDCARD_ONE  = "*"
+	WILDCARD_REST = "#"
+)
+
+var (
+	ErrPatternPublish = errors.New("cannot publish to a wildcard channel")
+)
+
+// Split a channel name into its segments
+func channelSegments(name string) []string {
+	return strings.Split(strings.Replace(name, "/", ".", -1), ".")
+}
+
+// Normalize the "**" form of the rest wildcard
+func patternSegment(seg string) string {
+	if seg == "**" {
+		return WILDCARD_REST
+	}
+	return seg
+}
+
+// Returns true if the channel name contains wildcard segments
+func isPattern(name string) bool {
+	if !strings.ContainsAny(name, WILDCARD_ONE+WILDCARD_REST) {
+		return false
+	}
+	for _, seg := range channelSegments(name) {
+		switch patternSegment(seg) {
+		case WILDCARD_ONE, WILDCARD_REST:
+			return true
+		}
+	}
+	return false
+}
+
+// Checks that a rest wildcard only appears as the last segment
+func validatePattern(name string) error {
+	segs := channelSegments(name)
+	for i, seg := range segs {
+		if patternSegment(seg) == WILDCARD_REST && i != len(segs)-1 {
+			return errors.New("wildcard " + seg + " must be the last segment of a channel pattern")
+		}
+	}
+	return nil
+}
+
+type patternNode struct {
+	children map[string]*patternNode
+	patterns []string // patterns ending at this node
+}
+
+func newPatternNode() *patternNode {
+	return &patternNode{children: make(map[string]*patternNode)}
+}
+
+type PatternTrie struct {
+	root *patternNode
+}
+
+func NewPatternTrie() *PatternTrie {
+	return &PatternTrie{root: newPatternNode()}
+}
+
+// Add a pattern to the index. Adding the same pattern
+// twice has no effect.
+func (t *PatternTrie) Add(pattern string) {
+	node := t.root
+	for _, seg := range channelSegments(pattern) {
+		seg = patternSegment(seg)
+		child, ok := node.children[seg]
+		if !ok {
+			child = newPatternNode()
+			node.children[seg] = child
+		}
+		node = child
+	}
+
+	for _, p := range node.patterns {
+		if p == pattern {
+			return
+		}
+	}
+	node.patterns = append(node.patterns, pattern)
+}
+
+// Remove a pattern from the index, pruning any branches
+// that no longer lead to a pattern
+func (t *PatternTrie) Remove(pattern string) {
+	segs := channelSegments(pattern)
+	path := make([]*patternNode, 0, len(segs)+1)
+
+	node := t.root
+	path = append(path, node)
+	for _, seg := range segs {
+		child, ok := node.children[patternSegment(seg)]
+		if !ok {
+			return
+		}
+		node = child
+		path = append(path, node)
+	}
+
+	for i := 0; i < len(node.patterns); i++ {
+		if node.patterns[i] == pattern {
+			node.patterns = append(node.patterns[:i], node.patterns[i+1:]...)
+			break
+		}
+	}
+
+	for i := len(segs); i > 0; i-- {
+		node = path[i]
+		if len(node.patterns) > 0 || len(node.children) > 0 {
+			break
+		}
+		delete(path[i-1].children, patternSegment(segs[i-1]))
+	}
+}
+
+// Returns the patterns that match a published channel name
+func (t *PatternTrie) Match(channel string) []string {
+	return t.root.match(channelSegments(channel), nil)
+}
+
+func (n *patternNode) match(segs []string, matched []string) []string {
+	if rest, ok := n.children[WILDCARD_REST]; ok {
+		matched = append(matched, rest.patterns...)
+	}
+
+	if len(segs) == 0 {
+		return append(matched, n.patterns...)
+	}
+
+	if child, ok := n.children[segs[0]]; ok {
+		matched = child.match(segs[1:], matched)
+	}
+	if child, ok := n.children[WILDCARD_ONE]; ok {
+		matched = child.match(segs[1:], matched)
+	}
+	return matched
+}
+
+// Returns true if every channel matched by name, a channel
+// or a pattern, is also matched by pattern
+func patternCovers(pattern, name string) bool {
+	return segmentsCover(channelSegments(pattern), channelSegments(name))
+}
+
+func segmentsCover(pattern, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+
+	seg := patternSegment(pattern[0])
+	if seg == WILDCARD_REST {
+		return true
+	}
+	if len(name) == 0 || patternSegment(name[0]) == WILDCARD_REST {
+		return false
+	}
+	if seg != WILDCARD_ONE && seg != name[0] {
+		return false
+	}
+	return segmentsCover(pattern[1:], name[1:])
+}
+
+// Returns true if some channel is matched by both a and b,
+// each a channel or a pattern
+func patternsOverlap(a, b string) bool {
+	return segmentsOverlap(channelSegments(a), channelSegments(b))
+}
+
+func segmentsOverlap(a, b []string) bool {
+	if len(a) > 0 && patternSegment(a[0]) == WILDCARD_REST {
+		return true
+	}
+	if len(b) > 0 && patternSegment(b[0]) == WILDCARD_REST {
+		return true
+	}
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+	if a[0] != WILDCARD_ONE && b[0] != WILDCARD_ONE && a[0] != b[0] {
+		return false
+	}
+	return segmentsOverlap(a[1:], b[1:])
+}
+
+// Returns true if pattern a is more specific than pattern b.
+// Compared segment by segment, the first that differs decides:
+// a name is more specific than *, which is more specific than
+// the rest wildcard, and ending there is the most specific of
+// all. Patterns that only differ in how they are written are
+// ordered by name, so the order is always the same.
+func moreSpecific(a, b string) bool {
+	segsA, segsB := channelSegments(a), channelSegments(b)
+	for i := 0; i < len(segsA) || i < len(segsB); i++ {
+		rankA, rankB := segmentRank(segsA, i), segmentRank(segsB, i)
+		if rankA != rankB {
+			return rankA < rankB
+		}
+	}
+	return a < b
+}
+
+// How general the segment at i is, for moreSpecific
+func segmentRank(segs []string, i int) int {
+	if i >= len(segs) {
+		return 0
+	}
+	switch patternSegment(segs[i]) {
+	case WILDCARD_ONE:
+		return 2
+	case WILDCARD_REST:
+		return 3
+	}
+	return 1
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+// TestPatternTrie
+// Subscribes a set of patterns and checks which ones
+// match various published channel names
+func TestPatternTrie(t *testing.T) {
+
+	trie := NewPatternTrie()
+	for _, p := range []string{
+		"orders.*.updated",
+		"orders.#",
+		"orders/**",
+		"*.created",
+		"users.*",
+	} {
+		trie.Add(p)
+	}
+
+	tests := []struct {
+		channel string
+		matches string
+	}{
+		{"orders.123.updated", "orders.#,orders.*.updated,orders/**"},
+		{"orders/123/updated", "orders.#,orders.*.updated,orders/**"},
+		{"orders.created", "*.created,orders.#,orders/**"},
+		{"orders.123.created", "orders.#,orders/**"},
+		{"orders", "orders.#,orders/**"},
+		{"users.bob", "users.*"},
+		{"users.bob.profile", ""},
+		{"users", ""},
+		{"chat", ""},
+	}
+
+	for _, test := range tests {
+		matched := trie.Match(test.channel)
+		sort.Strings(matched)
+		if strings.Join(matched, ",") != test.matches {
+			t.Errorf("Channel %q: expected matches [%v] but got %v", test.channel, test.matches, matched)
+		}
+	}
+
+	trie.Remove("orders.#")
+	trie.Remove("orders.*.updated")
+	if matched := trie.Match("orders.123.updated"); len(matched) != 1 || matched[0] != "orders/**" {
+		t.Fatalf("Expected only orders/** to match after removal, but got %v", matched)
+	}
+
+	trie.Remove("orders/**")
+	if _, ok := trie.root.children["orders"]; ok {
+		t.Fatal("Expected the orders branch to be pruned")
+	}
+}
+
+func TestValidatePattern(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"orders.*.updated": true,
+		"orders.#":         true,
+		"orders/**":        true,
+		"orders.#.updated": false,
+		"**.updated":       false,
+	} {
+		if err := validatePattern(name); (err == nil) != valid {
+			t.Errorf("Pattern %q: expected valid=%v but got error %v", name, valid, err)
+		}
+	}
+}
+
+func TestPatternCovers(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		covers        bool
+	}{
+		{"news", "news", true},
+		{"news", "sports", false},
+		{"news.*", "news.world", true},
+		{"news.*", "news.*", true},
+		{"news.*", "news", false},
+		{"news.*", "news.world.europe", false},
+		{"news.*", "news.#", false},
+		{"news.#", "news.world.europe", true},
+		{"news/**", "news.*", true},
+		{"news.#", "news", true},
+		{"*.world", "news.world", true},
+		{"news.world", "news.*", false},
+		{"#", "anything.at.all", true},
+	}
+
+	for _, test := range tests {
+		if covers := patternCovers(test.pattern, test.name); covers != test.covers {
+			t.Errorf("Expected %q covers %q to be %v", test.pattern, test.name, test.covers)
+		}
+	}
+}
+
+func TestMoreSpecific(t *testing.T) {
+	tests := []struct {
+		a, b string
+	}{
+		{"news.*", "news.#"},
+		{"news.eu.*", "news.*.*"},
+		{"news.eu.#", "news.*.west"},
+		{"*.eu", "#"},
+		{"news.*", "news.*.#"},
+		{"news.#", "news/**"},
+	}
+
+	for _, test := range tests {
+		if !moreSpecific(test.a, test.b) || moreSpecific(test.b, test.a) {
+			t.Errorf("Expected %q to be more specific than %q", test.a, test.b)
+		}
+	}
+}
+
+func TestPatternsOverlap(t *testing.T) {
+	tests := []struct {
+		a, b    string
+		overlap bool
+	}{
+		{"private.*", "private.alice", true},
+		{"private.*", "public.alice", false},
+		{"private.*", "*.alice", true},
+		{"private.*", "#", true},
+		{"private.*", "private", false},
+		{"private.*", "private.a.b", false},
+		{"private.#", "private", true},
+		{"private.#", "*.a.b", true},
+		{"a.*.c", "*.b.d", false},
+		{"news", "news", true},
+	}
+
+	for _, test := range tests {
+		if overlap := patternsOverlap(test.a, test.b); overlap != test.overlap {
+			t.Errorf("Expected %q overlaps %q to be %v", test.a, test.b, test.overlap)
+		}
+		if overlap := patternsOverlap(test.b, test.a); overlap != test.overlap {
+			t.Errorf("Expected %q overlaps %q to be %v", test.b, test.a, test.overlap)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+/*
+	Queue
+
+	Every connection gets its own bounded outbound queue and
+	writer goroutine, so a slow client only holds up its own
+	messages rather than the dispatcher. When a queue fills up,
+	the slow consumer policy decides what gives.
+
+	Drops are reported once per DROP_REPORT_INTERVAL while they
+	keep happening, whether or not the client ever catches up.
+*/
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	POLICY_DROP_OLDEST = "drop-oldest"
+	POLICY_DROP_NEWEST = "drop-newest"
+	POLICY_DISCONNECT  = "disconnect"
+
+	DROP_REPORT_INTERVAL = time.Second
+)
+
+var (
+	ErrQueueClosed = errors.New("connection outbound queue is closed")
+	ErrQueueFull   = errors.New("connection outbound queue is full. disconnecting slow consumer")
+
+	// not fatal. the connection stays, but didn't get the message
+	ErrMessageDropped = errors.New("connection outbound queue is full. message dropped")
+)
+
+// Checks the slow consumer policy is one that is supported
+func validPolicy(policy string) bool {
+	switch policy {
+	case POLICY_DROP_OLDEST, POLICY_DROP_NEWEST, POLICY_DISCONNECT:
+		return true
+	}
+	return false
+}
+
+// A ConnQueue wraps a Conn, queueing sends for its writer.
+// It has the same String() as the Conn it wraps.
+type ConnQueue struct {
+	Conn
+
+	size   int
+	policy string
+
+	queue   []interface{}
+	closing bool // no more sends. close the Conn once drained
+	closed  bool // stop writing altogether
+
+	dropped   uint64 // total messages dropped
+	reported  uint64 // dropped messages already reported
+	reporting bool   // a report is scheduled
+
+	// called with the number of messages dropped since
+	// the last report
+	onDropped func(q *ConnQueue, n uint64)
+
+	// closed when the writer stops
+	done chan struct{}
+
+	lock sync.Mutex
+	cond *sync.Cond
+}
+
+// Wraps the connection with a queue of the given size and
+// slow consumer policy, and starts its writer
+func NewConnQueue(c Conn, size int, policy string) *ConnQueue {
+	q := &ConnQueue{
+		Conn:   c,
+		size:   size,
+		policy: policy,
+		queue:  make([]interface{}, 0, size),
+		done:   make(chan struct{}),
+	}
+	q.cond = sync.NewCond(&q.lock)
+
+	go q.run()
+
+	return q
+}
+
+// Queue data to be sent. Returns an error if the queue has been
+// closed, or is full and the policy is to disconnect. Returns
+// ErrMessageDropped if the data was dropped to drop-newest.
+func (q *ConnQueue) Send(data interface{}) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.closed || q.closing {
+		return ErrQueueClosed
+	}
+
+	if len(q.queue) >= q.size {
+		switch q.policy {
+
+		case POLICY_DROP_NEWEST:
+			q.dropped++
+			q.scheduleReport()
+			return ErrMessageDropped
+
+		case POLICY_DISCONNECT:
+			// nothing left in the queue matters, except
+			// telling the client why it is being dropped
+			q.dropped += uint64(len(q.queue)) + 1
+			q.queue = append(q.queue[:0], NewErrorMessage(ErrQueueFull.Error()))
+			q.closing = true
+			q.scheduleReport()
+			q.cond.Signal()
+			return ErrQueueFull
+
+		default:
+			q.queue[0] = nil
+			q.queue = q.queue[1:]
+			q.dropped++
+			q.scheduleReport()
+		}
+	}
+
+	q.queue = append(q.queue, data)
+	q.cond.Signal()
+	return nil
+}
+
+// Reports the drops of a burst once the interval is up, so
+// the monitor isn't told about every single message. Must
+// be called with the lock held.
+func (q *ConnQueue) scheduleReport() {
+	if q.reporting || q.onDropped == nil {
+		return
+	}
+	q.reporting = true
+	time.AfterFunc(DROP_REPORT_INTERVAL, q.report)
+}
+
+func (q *ConnQueue) report() {
+	q.lock.Lock()
+	n := q.dropped - q.reported
+	q.reported = q.dropped
+	q.reporting = false
+	q.lock.Unlock()
+
+	if n > 0 {
+		q.onDropped(q, n)
+	}
+}
+
+// The number of messages dropped so far
+func (q *ConnQueue) Dropped() uint64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.dropped
+}
+
+// Stops taking sends, and closes the Conn once everything
+// already queued has been written
+func (q *ConnQueue) Drain() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.closing = true
+	q.cond.Signal()
+}
+
+// Stops the writer, discarding anything still queued.
+// The wrapped Conn is left to its transport to close.
+func (q *ConnQueue) Close() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.closed = true
+	q.queue = nil
+	q.cond.Signal()
+	return nil
+}
+
+// The writer. Sends queued data to the Conn in order
+func (q *ConnQueue) run() {
+	defer close(q.done)
+
+	var data interface{}
+
+	for {
+		q.lock.Lock()
+		for len(q.queue) == 0 && !q.closed && !q.closing {
+			q.cond.Wait()
+		}
+
+		if q.closed || len(q.queue) == 0 {
+			q.lock.Unlock()
+			break
+		}
+
+		data = q.queue[0]
+		q.queue[0] = nil
+		q.queue = q.queue[1:]
+		q.lock.Unlock()
+
+		if err := q.Conn.Send(data); err != nil {
+			Debugln("ConnQueue: Failed to send to connection", q, err)
+			q.lock.Lock()
+			q.closed = true
+			q.queue = nil
+			q.lock.Unlock()
+			return
+		}
+	}
+
+	q.lock.Lock()
+	closing := q.closing
+	q.closed = true
+	q.lock.Unlock()
+
+	// a slow consumer being disconnected, or
+	// the server shutting down
+	if closing {
+		if closer, ok := q.Conn.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// A Conn that blocks sends until released
+type slowConn struct {
+	id      string
+	release chan bool
+	lock    sync.Mutex
+	sent    []interface{}
+	closed  bool
+}
+
+func (c *slowConn) String() string { return c.id }
+
+func (c *slowConn) Send(data interface{}) error {
+	<-c.release
+	c.lock.Lock()
+	c.sent = append(c.sent, data)
+	c.lock.Unlock()
+	return nil
+}
+
+func (c *slowConn) Close() error {
+	c.lock.Lock()
+	c.closed = true
+	c.lock.Unlock()
+	return nil
+}
+
+func (c *slowConn) received() []interface{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.sent
+}
+
+func newSlowConn() *slowConn {
+	return &slowConn{id: "slow", release: make(chan bool)}
+}
+
+// Fill a queue of size 3 while the writer is stuck sending
+// the first message, then let everything through
+func fillQueue(t *testing.T, policy string) (*slowConn, *ConnQueue, []error) {
+	conn := newSlowConn()
+	q := NewConnQueue(conn, 3, policy)
+
+	errs := []error{q.Send(0)}
+
+	// wait for the writer to pick up the first message
+	for i := 0; i < 100; i++ {
+		q.lock.Lock()
+		n := len(q.queue)
+		q.lock.Unlock()
+		if n == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 1; i <= 5; i++ {
+		errs = append(errs, q.Send(i))
+	}
+	close(conn.release)
+
+	time.Sleep(50 * time.Millisecond)
+	return conn, q, errs
+}
+
+func TestConnQueueDropOldest(t *testing.T) {
+	conn, q, _ := fillQueue(t, POLICY_DROP_OLDEST)
+
+	sent := conn.received()
+	if len(sent) != 4 || sent[0] != 0 || sent[1] != 3 || sent[3] != 5 {
+		t.Fatalf("Expected messages [0 3 4 5] but got %v", sent)
+	}
+	if q.Dropped() != 2 {
+		t.Fatalf("Expected 2 dropped messages but got %d", q.Dropped())
+	}
+}
+
+func TestConnQueueDropNewest(t *testing.T) {
+	conn, q, errs := fillQueue(t, POLICY_DROP_NEWEST)
+
+	sent := conn.received()
+	if len(sent) != 4 || sent[0] != 0 || sent[1] != 1 || sent[3] != 3 {
+		t.Fatalf("Expected messages [0 1 2 3] but got %v", sent)
+	}
+	if q.Dropped() != 2 {
+		t.Fatalf("Expected 2 dropped messages but got %d", q.Dropped())
+	}
+	if errs[3] != nil || errs[4] != ErrMessageDropped || errs[5] != ErrMessageDropped {
+		t.Fatalf("Expected the dropped sends to say so, but got errors %v", errs)
+	}
+}
+
+// TestConnQueueReportDropped
+// Checks drops are reported while the consumer is still stuck,
+// and a dropped message isn't counted as delivered to a Client
+func TestConnQueueReportDropped(t *testing.T) {
+	conn := newSlowConn()
+	defer close(conn.release)
+
+	reports := make(chan uint64, 10)
+	q := NewConnQueue(conn, 1, POLICY_DROP_NEWEST)
+	q.onDropped = func(q *ConnQueue, n uint64) { reports <- n }
+	defer q.Close()
+
+	client := &Client{Conns: []Conn{q}}
+
+	// one for the stuck writer, one to fill the queue
+	for i := 0; i < 2; i++ {
+		q.Send(i)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if sent := client.Send(2); sent != 0 {
+		t.Fatalf("Expected a dropped message to not count as sent, but got %d", sent)
+	}
+	client.Send(3)
+
+	select {
+	case n := <-reports:
+		if n != 2 {
+			t.Fatalf("Expected 2 dropped messages to be reported but got %d", n)
+		}
+	case <-time.After(DROP_REPORT_INTERVAL + time.Second):
+		t.Fatal("Expected the drops to be reported while the consumer is stuck")
+	}
+}
+
+func TestConnQueueDisconnect(t *testing.T) {
+	conn, _, errs := fillQueue(t, POLICY_DISCONNECT)
+
+	if errs[4] != ErrQueueFull || errs[5] != ErrQueueClosed {
+		t.Fatalf("Expected the queue to fill and close, but got errors %v", errs)
+	}
+
+	sent := conn.received()
+	if len(sent) != 2 {
+		t.Fatalf("Expected the first message and an error reply, but got %v", sent)
+	}
+	if msg, ok := sent[1].(*message); !ok || msg.Success {
+		t.Fatalf("Expected an error reply but got %v", sent[1])
+	}
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if !conn.closed {
+		t.Fatal("Expected the slow connection to be closed")
+	}
+}
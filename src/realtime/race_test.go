@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// TestConcurrentClients
+// Many connections subscribe, publish, unsubscribe and disconnect
+// at the same time, sharing identities and channels. Run with
+// -race. Once everyone has gone, no subscriptions, identities
+// or queues should be left behind.
+func TestConcurrentClients(t *testing.T) {
+
+	setTestConfig(t, func(conf *Config) {
+		conf.DISPATCH_SHARDS = 4
+		conf.HISTORY_SIZE = 10
+	})
+
+	server := NewServerHandler(nil)
+	defer server.Shutdown()
+
+	const (
+		numConns    = 40
+		numMessages = 20
+	)
+
+	conns := make([]*benchConn, numConns)
+	for i := range conns {
+		conns[i] = &benchConn{id: fmt.Sprintf("race-%d", i)}
+	}
+
+	send := func(c Conn, format string, args ...interface{}) {
+		server.OnRawMessage(c, []byte(fmt.Sprintf(format, args...)))
+	}
+
+	var wg sync.WaitGroup
+
+	for i, conn := range conns {
+		wg.Add(1)
+		go func(i int, conn *benchConn) {
+			defer wg.Done()
+
+			// connections share identities, so groups grow and
+			// shrink while their channels are being dispatched
+			identity := fmt.Sprintf("user-%d", i%5)
+			channel := fmt.Sprintf("race.%d", i%4)
+
+			send(conn, `{"type":"command","identity":%q,"data":{"command":"init","options":{"channels":[%q,"race.*"]}}}`,
+				identity, channel)
+
+			for n := 0; n < numMessages; n++ {
+				send(conn, `{"type":"message","channel":%q,"data":{"n":%d}}`, channel, n)
+				send(conn, `{"type":"message","to":"user-%d","data":{"n":%d}}`, n%5, n)
+			}
+
+			send(conn, `{"type":"command","channel":%q,"data":{"command":"presence"}}`, channel)
+			send(conn, `{"type":"command","channel":"race.*","data":{"command":"unsubscribe"}}`)
+			send(conn, `{"type":"command","channel":"race.extra","data":{"command":"subscribe"}}`)
+
+			server.OnDisconnect(conn)
+		}(i, conn)
+	}
+
+	wg.Wait()
+	server.flushMessages()
+
+	// wait out any (un)subscribes still queued. a connection
+	// without a Client record is turned away, but only once the
+	// shard gets to it
+	barrier := &benchConn{id: "barrier"}
+	for _, sh := range server.shards {
+		req := NewDispatchReq(barrier, NewCommand(), true)
+		req.Msg.Data["command"] = "subscribe"
+		sh.srvcChannel <- req
+		<-req.done
+
+		if len(sh.subs) > 0 {
+			t.Errorf("Expected no channel subscriptions to be left, but got %v", sh.subs)
+		}
+	}
+
+	server.patternsLock.RLock()
+	if len(server.patternSubs) > 0 {
+		t.Errorf("Expected no pattern subscriptions to be left, but got %v", server.patternSubs)
+	}
+	server.patternsLock.RUnlock()
+
+	server.identsLock.RLock()
+	if len(server.idents) > 0 {
+		t.Errorf("Expected no identities to be left, but got %v", server.idents)
+	}
+	server.identsLock.RUnlock()
+
+	server.clientsLock.RLock()
+	if len(server.clients) > 0 {
+		t.Errorf("Expected no clients to be left, but got %v", server.clients)
+	}
+	server.clientsLock.RUnlock()
+
+	server.queuesLock.Lock()
+	if len(server.queues) > 0 {
+		t.Errorf("Expected no outbound queues to be left, but got %d", len(server.queues))
+	}
+	server.queuesLock.Unlock()
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"crypto/rsa"
 	"flag"
 	"fmt"
 	"log"
@@ -9,7 +11,6 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
-	"strings"
 	"syscall"
 	"time"
 	//"http/pprof"
@@ -23,10 +24,11 @@ import (
 //
 
 var (
-	SERVER  *ServerHandler
-	CONFIG  Config
-	ROOT    string
-	LICENSE License
+	SERVER   *ServerHandler
+	CONFIG   Config
+	ROOT     string
+	LICENSE  License
+	API_KEYS APIKeys
 )
 
 const (
@@ -34,14 +36,59 @@ const (
 )
 
 type Config struct {
-	DEBUG           bool
-	PORT            int
-	HWM             int
-	CONN_TIMEOUT    int
-	DOMAINS         []string
-	ALLOWED_TYPES   []string
-	MONITOR_URL     *url.URL
-	MONITOR_IS_JSON bool
+	DEBUG            bool
+	PORT             int
+	HWM              int
+	HISTORY_SIZE     int
+	HISTORY_MAX_AGE  int
+	OUTBOUND_QUEUE   int
+	SLOW_CONSUMER    string
+	DISPATCH_SHARDS  int
+	CONN_TIMEOUT     int
+	SHUTDOWN_TIMEOUT int
+	DOMAINS          []string
+	ALLOWED_TYPES    []string
+	MONITOR_URL      *url.URL
+	MONITOR_IS_JSON  bool
+
+	LEGACY_TIMESTAMPS bool
+	LICENSE_SECRET    string
+
+	AUTH_SECRET     string
+	AUTH_PUBLIC_KEY *rsa.PublicKey
+	AUTH_REQUIRED   bool
+	AUTH_URL        *url.URL
+	AUTH_CACHE_TTL  int
+	AUTH_TIMEOUT    int
+	AUTH_FAIL_OPEN  bool
+
+	API_KEYS_FILE string
+
+	ACL_RULES []ACLRule
+
+	BROADCAST_CHANNELS   []string
+	BROADCAST_PUBLISHERS []string
+}
+
+func defaultConfig() Config {
+	return Config{
+		DEBUG:            false,
+		DOMAINS:          []string{"*"},
+		ALLOWED_TYPES:    []string{},
+		PORT:             8001,
+		HWM:              5000,
+		HISTORY_SIZE:     0,
+		HISTORY_MAX_AGE:  0,
+		OUTBOUND_QUEUE:   1000,
+		SLOW_CONSUMER:    POLICY_DROP_OLDEST,
+		DISPATCH_SHARDS:  0,
+		CONN_TIMEOUT:     5,
+		SHUTDOWN_TIMEOUT: 10,
+		MONITOR_IS_JSON:  true,
+		LICENSE_SECRET:   string(PADDING),
+		AUTH_CACHE_TTL:   60,
+		AUTH_TIMEOUT:     5,
+	}
 }
 
 func init() {
@@ -49,21 +96,14 @@ func init() {
 	root, _ := filepath.Split(os.Args[0])
 	ROOT, _ = filepath.Abs(root)
 
-	CONFIG = Config{
-		DEBUG:           false,
-		DOMAINS:         []string{"*"},
-		ALLOWED_TYPES:   []string{},
-		PORT:            8001,
-		HWM:             5000,
-		CONN_TIMEOUT:    5,
-		MONITOR_IS_JSON: true,
-	}
+	CONFIG = defaultConfig()
 
 	var err error
 	LICENSE, err = NewLicense()
 	if err != nil {
 		log.Println("Warning: No valid license keys were found. Only localhost connections are permitted.")
 	}
+	applyConfig()
 }
 
 //
@@ -75,36 +115,8 @@ func main() {
 	//var domainVal string
 
 	if c, err := getConf(); err == nil {
-
-		if v, e := c.Bool("Server", "debug"); e == nil {
-			CONFIG.DEBUG = v
-		}
-		if v, e := c.Int("Server", "websocket-port"); e == nil {
-			CONFIG.PORT = v
-		}
-		if v, e := c.Int("Server", "reconnect-timeout"); e == nil {
-			CONFIG.CONN_TIMEOUT = v
-		}
-
-		if v, e := c.String("Monitor", "url"); e == nil {
-			CONFIG.MONITOR_URL, e = url.Parse(v)
-			if e != nil {
-				log.Fatalf("Monitor URL \"%v\" is not valid\n", v)
-			}
-		}
-
-		if v, e := c.Int("Messaging", "message-cache-limit"); e == nil {
-			CONFIG.HWM = v
-		}
-
-		if v, e := c.String("Server", "allowed-types"); e == nil && v != "" {
-			types := strings.Split(v, ",")
-			for i, s := range types {
-				types[i] = strings.TrimSpace(s)
-			}
-			if len(types) > 0 {
-				CONFIG.ALLOWED_TYPES = types
-			}
+		if err = readConfig(c, &CONFIG); err != nil {
+			log.Fatalln(err)
 		}
 	}
 
@@ -113,13 +125,48 @@ func main() {
 
 	flag.Parse()
 
-	if *fDebug {
-		CONFIG.DEBUG = true
+	// command line options and the environment win over
+	// the config file, both on startup and on a reload
+	overrides := func(conf *Config) {
+		if *fDebug {
+			conf.DEBUG = true
+		}
+		if *fPort > 0 {
+			conf.PORT = *fPort
+		}
+		if v := os.Getenv(LICENSE_SECRET_ENV); v != "" {
+			conf.LICENSE_SECRET = v
+		}
+	}
+	overrides(&CONFIG)
+	applyConfig()
+
+	if flag.Arg(0) == "license" {
+		os.Exit(licenseCmd(flag.Args()[1:], os.Stdout))
 	}
-	if *fPort > 0 {
-		CONFIG.PORT = *fPort
+
+	if CONFIG.LICENSE_SECRET == string(PADDING) {
+		log.Printf("Warning: Using the built-in license secret. Set one with [License] secret or $%v", LICENSE_SECRET_ENV)
 	}
 
+	keys, err := NewAPIKeys(CONFIG)
+	if err != nil {
+		log.Fatal("API keys: ", err)
+	} else if keys != nil {
+		log.Printf("API keys are required to publish. %d keys loaded", len(keys))
+	}
+	API_KEYS = keys
+	applyConfig()
+
+	// warn about license tokens that are invalid or expiring,
+	// now and then once a day
+	checkLicense()
+	go func() {
+		for range time.Tick(LICENSE_CHECK_INTERVAL) {
+			checkLicense()
+		}
+	}()
+
 	log.Printf("Using config options: DEBUG=%v, PORT=%v, CONN_TIMEOUT=%v, MON=%v",
 		CONFIG.DEBUG, CONFIG.PORT, CONFIG.CONN_TIMEOUT, CONFIG.MONITOR_URL)
 
@@ -156,17 +203,47 @@ func main() {
 	// sio.OnConnect(func(c *socketio.Conn) { SERVER.OnConnect(c) })
 	sio.OnDisconnect(func(c *socketio.Conn) { SERVER.OnDisconnect(c) })
 	sio.OnMessage(func(c *socketio.Conn, msg socketio.Message) { SERVER.OnMessage(c, msg) })
-	sio.SetAuthorization(func(r *http.Request) bool { return LICENSE.CheckHttpRequest(r) })
+	sio.SetAuthorization(func(r *http.Request) bool { return currentLicense().CheckHttpRequest(r) })
+
+	server := &http.Server{Addr: fmt.Sprintf(":%v", CONFIG.PORT)}
+	stopped := make(chan bool)
 
-	// start a signal handler
+	// start a signal handler. SIGHUP reloads the config
+	// and licenses, anything else shuts down
 	sigChan := make(chan os.Signal, 2)
-	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
 	go func() {
-		for s := range sigChan {
-			log.Printf("Caught Signal %v - Server shutting down.\n", s)
-			SERVER.Shutdown()
-			os.Exit(0)
+		var s os.Signal
+		for s = range sigChan {
+			if s != syscall.SIGHUP {
+				break
+			}
+			log.Printf("Caught Signal %v - Reloading config.\n", s)
+			reloadConfig(overrides)
 		}
+		log.Printf("Caught Signal %v - Server shutting down.\n", s)
+
+		timeout := time.Duration(currentConfig().SHUTDOWN_TIMEOUT) * time.Second
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		// stop accepting connections right away. the http server
+		// then waits on the open requests, which the ServerHandler
+		// ends as it disconnects everyone
+		httpDone := make(chan bool)
+		go func() {
+			if err := server.Shutdown(ctx); err != nil {
+				log.Println("[WARN] HTTP server shutdown:", err)
+			}
+			httpDone <- true
+		}()
+
+		SERVER.Shutdown()
+		<-httpDone
+
+		logAPIKeyUsage()
+
+		stopped <- true
 	}()
 
 	// start the flash server
@@ -179,6 +256,11 @@ func main() {
 	// mux and server
 	mux := sio.ServeMux()
 	mux.Handle("/api/publish", http.HandlerFunc(HandlePostAPIPublish))
+	mux.Handle("/api/subscribe", http.HandlerFunc(HandleGetAPISubscribe))
+
+	// plain websocket transport. socket.io owns everything
+	// under its /realtime/ resource, so this lives with the api
+	mux.Handle("/api/ws", NewWebsocketHandler())
 
 	// this is a temporary static dir for testing
 	mux.Handle("/", http.FileServer(http.Dir(filepath.Join(ROOT, "www/"))))
@@ -191,13 +273,15 @@ func main() {
 	*/
 
 	// start server
-	log.Printf("RealTime server starting. Accepting connections on port :%v", CONFIG.PORT)
+	log.Printf("RealTime server starting. Accepting connections on port :%v", currentConfig().PORT)
 
-	if err := http.ListenAndServe(fmt.Sprintf(":%v", CONFIG.PORT), mux); err != nil {
+	server.Handler = mux
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
 		log.Fatal("ListenAndServe:", err)
 		os.Exit(2)
 	}
 
+	<-stopped
 	os.Exit(0)
 
 }
@@ -208,13 +292,13 @@ func fileExists(f string) bool {
 }
 
 func Debugln(v ...interface{}) {
-	if CONFIG.DEBUG {
+	if currentConfig().DEBUG {
 		log.Println(v...)
 	}
 }
 
 func Debugf(f string, v ...interface{}) {
-	if CONFIG.DEBUG {
+	if currentConfig().DEBUG {
 		log.Printf(f, v...)
 	}
 }
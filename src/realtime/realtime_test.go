@@ -1,9 +1,11 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"github.com/justinfx/go-socket.io/socketio"
+	"sort"
 	"sync"
 	"testing"
 	"time"
@@ -177,7 +179,7 @@ func connectClient(t *testing.T) (*socketio.WebsocketClient, chan *message, chan
 // with proper data values.
 func TestMessages(t *testing.T) {
 
-	CONFIG.DEBUG = false
+	setTestConfig(t, func(conf *Config) { conf.DEBUG = false })
 
 	serverEvents := startServer()
 	client, clientMessage, clientDisconnect := connectClient(t)
@@ -265,6 +267,398 @@ func TestMessages(t *testing.T) {
 	}
 
 	_SERVER.Shutdown()
+}
+
+// TestTimestamps
+// Checks messages, commands and monitor messages are stamped in
+// RFC 3339 with milliseconds since the epoch, or in the old
+// format with legacy timestamps
+func TestTimestamps(t *testing.T) {
+
+	const legacyLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+	tests := []struct {
+		name   string
+		legacy bool
+		layout string
+		stamp  func() interface{}
+	}{
+		{"message", false, time.RFC3339Nano, func() interface{} { return NewMessage() }},
+		{"command", false, time.RFC3339Nano, func() interface{} { return NewCommand() }},
+		{"monitor", false, time.RFC3339Nano, func() interface{} { return NewMonitorMessage() }},
+		{"legacy message", true, legacyLayout, func() interface{} { return NewMessage() }},
+		{"legacy command", true, legacyLayout, func() interface{} { return NewCommand() }},
+		{"legacy monitor", true, legacyLayout, func() interface{} { return NewMonitorMessage() }},
+	}
+
+	for _, test := range tests {
+		legacy := test.legacy
+		setTestConfig(t, func(conf *Config) { conf.LEGACY_TIMESTAMPS = legacy })
+
+		before := time.Now().UnixNano() / int64(time.Millisecond)
+		raw, _ := json.Marshal(test.stamp())
+		after := time.Now().UnixNano() / int64(time.Millisecond)
+
+		var stamped struct {
+			Timestamp string
+			EpochMs   int64 `json:"timestamp_ms"`
+		}
+		if err := json.Unmarshal(raw, &stamped); err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+
+		ts, err := time.Parse(test.layout, stamped.Timestamp)
+		if err != nil {
+			t.Errorf("%v: Expected a timestamp in the %q layout but got %q", test.name, test.layout, stamped.Timestamp)
+			continue
+		}
+		if stamped.EpochMs < before || stamped.EpochMs > after {
+			t.Errorf("%v: Expected timestamp_ms between %d and %d but got %d", test.name, before, after, stamped.EpochMs)
+		}
+		if ms := ts.UnixNano() / int64(time.Millisecond); ms != stamped.EpochMs {
+			t.Errorf("%v: Expected the timestamp %v to match timestamp_ms %d", test.name, stamped.Timestamp, stamped.EpochMs)
+		}
+	}
+}
 
-	CONFIG.DEBUG = false
+// TestInitChannels
+// Checks that the batch channel list in an init command
+// is unboxed from the decoded JSON, and bad entries rejected
+func TestInitChannels(t *testing.T) {
+
+	msg, err := NewJsonMessage([]byte(`{"type":"command","data":{"command":"init",` +
+		`"options":{"channels":["chat", "", 5, "news"]}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channels, rejected := initChannels(msg)
+	if len(channels) != 2 || channels[0] != "chat" || channels[1] != "news" {
+		t.Fatalf("Expected channels [chat news] but got %v", channels)
+	}
+	if len(rejected) != 2 {
+		t.Fatalf("Expected 2 rejected channels but got %v", rejected)
+	}
+
+	msg, _ = NewJsonMessage([]byte(`{"type":"command","data":{"command":"init"}}`))
+	if channels, rejected = initChannels(msg); len(channels) != 0 || len(rejected) != 0 {
+		t.Fatalf("Expected no channels but got %v, %v", channels, rejected)
+	}
+}
+
+// TestExclude
+// Checks publishers can leave their own connection, or identity,
+// out of a message, per message or per subscription
+func TestExclude(t *testing.T) {
+
+	setTestConfig(t, func(conf *Config) { conf.OUTBOUND_QUEUE = 0 })
+
+	server := NewServerHandler(nil)
+	defer server.Shutdown()
+
+	send := func(c Conn, raw string) {
+		server.OnRawMessage(c, []byte(raw))
+	}
+	isMessage := func(msg *message) bool { return msg.Type == "message" }
+	expect := func(c *recordConn, text string) {
+		if msg := c.until(t, isMessage); msg.Data["text"] != text || msg.Error != "" {
+			t.Fatalf("%v: Expected %q but got %+v", c, text, msg)
+		}
+	}
+
+	alice1, alice2, bob := newRecordConn("alice1"), newRecordConn("alice2"), newRecordConn("bob")
+	for _, c := range []*recordConn{alice1, alice2} {
+		send(c, `{"type":"command","identity":"alice","data":{"command":"init","channels":["chat"]}}`)
+		defer server.OnDisconnect(c)
+	}
+	send(bob, `{"type":"command","data":{"command":"init","channels":["chat"]}}`)
+	defer server.OnDisconnect(bob)
+
+	send(alice1, `{"type":"message","identity":"alice","channel":"chat","exclude":"connection","data":{"text":"one"}}`)
+	send(alice1, `{"type":"message","identity":"alice","channel":"chat","data":{"text":"two"}}`)
+	expect(alice1, "two")
+	expect(alice2, "one")
+	expect(alice2, "two")
+	expect(bob, "one")
+
+	send(alice1, `{"type":"message","identity":"alice","channel":"chat","exclude":"identity","data":{"text":"three"}}`)
+	send(bob, `{"type":"message","channel":"chat","data":{"text":"four"}}`)
+	expect(alice1, "four")
+	expect(alice2, "four")
+	expect(bob, "two")
+	expect(bob, "three")
+
+	// by subscription, unless the message says otherwise
+	send(bob, `{"type":"command","channel":"news.*","data":{"command":"subscribe","options":{"exclude":"identity"}}}`)
+	send(bob, `{"type":"message","channel":"news.eu","data":{"text":"five"}}`)
+	send(bob, `{"type":"message","channel":"news.eu","exclude":"none","data":{"text":"six"}}`)
+	expect(bob, "four")
+	expect(bob, "six")
+
+	// the most specific subscription decides, and subscribing
+	// again changes its option
+	send(bob, `{"type":"command","channel":"news.#","data":{"command":"subscribe","options":{"exclude":"none"}}}`)
+	send(bob, `{"type":"message","channel":"news.eu","data":{"text":"eight"}}`)
+	send(bob, `{"type":"message","channel":"news.eu.west","data":{"text":"nine"}}`)
+	expect(bob, "nine")
+
+	send(bob, `{"type":"command","channel":"news.*","data":{"command":"subscribe","options":{"exclude":"none"}}}`)
+	send(bob, `{"type":"message","channel":"news.eu","data":{"text":"ten"}}`)
+	expect(bob, "ten")
+
+	send(bob, `{"type":"message","channel":"chat","exclude":"everyone","data":{"text":"seven"}}`)
+	if msg := bob.until(t, isMessage); msg.Error != ErrInvalidExclude.Error() {
+		t.Fatalf("Expected an invalid exclude to be refused but got %+v", msg)
+	}
+}
+
+// TestPresenceConnections
+// Checks an identity joins a channel with its first connection,
+// and only leaves with its last, along with its presence metadata
+func TestPresenceConnections(t *testing.T) {
+
+	setTestConfig(t, func(conf *Config) { conf.OUTBOUND_QUEUE = 0 })
+
+	server := NewServerHandler(nil)
+	defer server.Shutdown()
+
+	send := func(c Conn, raw string) {
+		server.OnRawMessage(c, []byte(raw))
+	}
+	isPresence := func(msg *message) bool {
+		return msg.Data["command"] == "onJoin" || msg.Data["command"] == "onLeave" || msg.Data["msg"] == "marker"
+	}
+	// the next presence event bob sees, or the marker if there is none
+	nextEvent := func(bob *recordConn) *message {
+		send(bob, `{"type":"message","channel":"room","data":{"msg":"marker"}}`)
+		msg := bob.until(t, isPresence)
+		if msg.Data["msg"] != "marker" {
+			bob.until(t, func(msg *message) bool { return msg.Data["msg"] == "marker" })
+		}
+		return msg
+	}
+
+	bob := newRecordConn("bob")
+	send(bob, `{"type":"command","identity":"bob","data":{"command":"init","channels":["room"]}}`)
+	defer server.OnDisconnect(bob)
+	bob.until(t, func(msg *message) bool { return msg.Data["command"] == "onInit" })
+
+	alice1, alice2 := newRecordConn("alice1"), newRecordConn("alice2")
+	for _, c := range []*recordConn{alice1, alice2} {
+		send(c, `{"type":"command","identity":"alice","data":{"command":"init"}}`)
+		defer server.OnDisconnect(c)
+	}
+
+	send(alice1, `{"type":"command","channel":"room","data":{"command":"subscribe","options":{"presence":{"status":"away"}}}}`)
+	msg := nextEvent(bob)
+	if meta, _ := msg.Data["presence"].(map[string]interface{}); msg.Data["command"] != "onJoin" || msg.Identity != "alice" || meta["status"] != "away" {
+		t.Fatalf("Expected alice to join with her presence but got %+v", msg)
+	}
+
+	send(alice2, `{"type":"command","channel":"room","data":{"command":"subscribe"}}`)
+	if msg = nextEvent(bob); msg.Data["msg"] != "marker" {
+		t.Fatalf("Expected no second onJoin for alice but got %+v", msg)
+	}
+
+	send(bob, `{"type":"command","channel":"room","data":{"command":"presence"}}`)
+	msg = bob.until(t, func(msg *message) bool { return msg.Data["command"] == "onPresence" })
+	if meta, _ := msg.Data["presence"].(map[string]interface{}); msg.Data["count"] != 2 ||
+		fmt.Sprint(meta["alice"]) != "map[status:away]" {
+		t.Fatalf("Expected bob and alice, with her presence, but got %+v", msg.Data)
+	}
+
+	// one tab leaves
+	send(alice1, `{"type":"command","channel":"room","data":{"command":"unsubscribe"}}`)
+	alice1.until(t, func(msg *message) bool { return msg.Data["command"] == "onUnsubscribe" })
+	if msg = nextEvent(bob); msg.Data["msg"] != "marker" {
+		t.Fatalf("Expected alice to stay while her other connection is subscribed but got %+v", msg)
+	}
+
+	// and the other one disconnects
+	server.OnDisconnect(alice2)
+	if msg = nextEvent(bob); msg.Data["command"] != "onLeave" || msg.Identity != "alice" {
+		t.Fatalf("Expected alice to leave with her last connection but got %+v", msg)
+	}
+
+	// a disconnect doesn't take the subscriptions of the other connections
+	send(alice1, `{"type":"command","channel":"room","data":{"command":"subscribe"}}`)
+	if msg = nextEvent(bob); msg.Data["command"] != "onJoin" {
+		t.Fatalf("Expected alice to join again but got %+v", msg)
+	}
+	alice3 := newRecordConn("alice3")
+	send(alice3, `{"type":"command","identity":"alice","data":{"command":"init"}}`)
+	server.OnDisconnect(alice3)
+	if msg = nextEvent(bob); msg.Data["msg"] != "marker" {
+		t.Fatalf("Expected alice to stay subscribed but got %+v", msg)
+	}
+}
+
+// TestDirectMessages
+// Sends direct messages from a connection and through the api,
+// and checks every connection of the identity gets them, and
+// that a message to an offline identity is refused
+func TestDirectMessages(t *testing.T) {
+
+	setTestConfig(t, func(conf *Config) { conf.OUTBOUND_QUEUE = 0 })
+
+	SERVER = NewServerHandler(nil)
+	defer SERVER.Shutdown()
+
+	send := func(c Conn, raw string) {
+		SERVER.OnRawMessage(c, []byte(raw))
+	}
+	isMessage := func(msg *message) bool { return msg.Type == "message" }
+
+	alice1, alice2, bob := newRecordConn("alice1"), newRecordConn("alice2"), newRecordConn("bob")
+	send(alice1, `{"type":"command","identity":"alice","data":{"command":"init"}}`)
+	send(alice2, `{"type":"command","identity":"alice","data":{"command":"init"}}`)
+	send(bob, `{"type":"command","identity":"bob","data":{"command":"init"}}`)
+	for _, c := range []*recordConn{alice1, alice2, bob} {
+		defer SERVER.OnDisconnect(c)
+	}
+
+	send(bob, `{"type":"message","to":"alice","data":{"text":"hi"}}`)
+	if rec := postPublish(`{"type":"message","to":"alice","data":{"text":"from the api"}}`); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the api direct message to be sent but got %d: %s", rec.Code, rec.Body.String())
+	}
+	for _, c := range []*recordConn{alice1, alice2} {
+		for _, text := range []string{"hi", "from the api"} {
+			if msg := c.until(t, isMessage); msg.Data["text"] != text || msg.To != "alice" {
+				t.Fatalf("%v: Expected the direct message %q but got %+v", c, text, msg)
+			}
+		}
+	}
+
+	send(bob, `{"type":"message","to":"nobody","data":{"text":"hello?"}}`)
+	if msg := bob.until(t, isMessage); msg.Error != ErrIdentityOffline.Error() || msg.Data["to"] != "nobody" {
+		t.Fatalf("Expected an offline error for nobody but got %+v", msg)
+	}
+	if rec := postPublish(`{"type":"message","to":"nobody","data":{"text":"hello?"}}`); rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected the api to refuse a message to an offline identity but got %d", rec.Code)
+	}
+}
+
+// TestInitSubscribe
+// Checks the init channels are subscribed all together, with an
+// onSubscribe for each before the onInit, or not at all when
+// one of them is invalid
+func TestInitSubscribe(t *testing.T) {
+
+	setTestConfig(t, func(conf *Config) { conf.OUTBOUND_QUEUE = 0 })
+
+	server := NewServerHandler(nil)
+	defer server.Shutdown()
+
+	send := func(c Conn, raw string) {
+		server.OnRawMessage(c, []byte(raw))
+	}
+	// the onSubscribe channels sent before the onInit, and the onInit
+	untilInit := func(c *recordConn) (subscribes []string, init *message) {
+		for {
+			msg := c.next(t)
+			switch msg.Data["command"] {
+			case "onSubscribe":
+				subscribes = append(subscribes, msg.Channel)
+			case "onInit":
+				return subscribes, msg
+			}
+		}
+	}
+
+	anon := newRecordConn("anon")
+	send(anon, `{"type":"command","data":{"command":"init","options":{"channels":["a","b","c.#.x"]}}}`)
+	defer server.OnDisconnect(anon)
+
+	subscribes, init := untilInit(anon)
+	rejected, _ := init.Data["rejected"].(map[string]string)
+	if len(subscribes) != 0 || len(init.Data["subscribed"].([]string)) != 0 {
+		t.Fatalf("Expected nothing to be subscribed but got %v and %+v", subscribes, init.Data)
+	}
+	if rejected["c.#.x"] == "" || rejected["a"] != ErrInitRejected.Error() || rejected["b"] != ErrInitRejected.Error() {
+		t.Fatalf("Expected every channel to be rejected but got %v", rejected)
+	}
+
+	bob := newRecordConn("bob")
+	send(bob, `{"type":"command","identity":"bob","data":{"command":"init","options":{"channels":["a","b"]}}}`)
+	defer server.OnDisconnect(bob)
+
+	subscribes, init = untilInit(bob)
+	sort.Strings(subscribes)
+	if fmt.Sprint(subscribes) != "[a b]" || fmt.Sprint(init.Data["subscribed"]) != "[a b]" || len(init.Data["rejected"].(map[string]string)) != 0 {
+		t.Fatalf("Expected onSubscribe for a and b before the onInit but got %v and %+v", subscribes, init.Data)
+	}
+
+	// the rejected init left nothing behind
+	send(bob, `{"type":"command","channel":"a","data":{"command":"presence"}}`)
+	msg := bob.until(t, func(msg *message) bool { return msg.Data["command"] == "onPresence" })
+	if msg.Data["count"] != 1 {
+		t.Fatalf("Expected only bob on channel a but got %+v", msg.Data)
+	}
+
+	// another connection of bob joins the subscriptions, and
+	// hears about each of them too
+	bob2 := newRecordConn("bob2")
+	send(bob2, `{"type":"command","identity":"bob","data":{"command":"init","options":{"channels":["a","b"]}}}`)
+	defer server.OnDisconnect(bob2)
+
+	subscribes, init = untilInit(bob2)
+	sort.Strings(subscribes)
+	if fmt.Sprint(subscribes) != "[a b]" || fmt.Sprint(init.Data["subscribed"]) != "[a b]" {
+		t.Fatalf("Expected onSubscribe for a and b before the onInit but got %v and %+v", subscribes, init.Data)
+	}
+}
+
+// A Conn whose Send blocks while the gate is locked
+type gateConn struct {
+	id   string
+	gate sync.Mutex
+}
+
+func (c *gateConn) String() string { return c.id }
+
+func (c *gateConn) Send(data interface{}) error {
+	c.gate.Lock()
+	c.gate.Unlock()
+	return nil
+}
+
+// TestShutdownTimeout
+// Shuts down with a shard stuck sending to a connection, and
+// checks the shutdown still returns once its timeout is up
+func TestShutdownTimeout(t *testing.T) {
+
+	setTestConfig(t, func(conf *Config) {
+		conf.DISPATCH_SHARDS = 1
+		conf.OUTBOUND_QUEUE = 0
+		conf.SHUTDOWN_TIMEOUT = 1
+	})
+
+	server := NewServerHandler(nil)
+
+	stuck := &gateConn{id: "stuck"}
+	server.OnRawMessage(stuck, []byte(`{"type":"command","data":{"command":"init","channels":["chat"]}}`))
+	stuck.gate.Lock()
+
+	msg := NewMessage()
+	msg.Channel = "chat"
+	msg.Data["text"] = "stuck"
+	if err := server.publish(nil, msg); err != nil {
+		t.Fatal("publish:", err)
+	}
+
+	done := make(chan bool)
+	go func() {
+		server.Shutdown()
+		done <- true
+	}()
+
+	// the shard gets going again after the timeout
+	time.Sleep(1500 * time.Millisecond)
+	stuck.gate.Unlock()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the shutdown to give up after its timeout")
+	}
 }
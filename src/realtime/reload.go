@@ -0,0 +1,188 @@
+package main
+
+/*
+	Reload
+
+	On SIGHUP the config file, licenses and API keys are read
+	again and applied to the running server, without dropping any
+	connections. Anything other than main reads them through
+	currentConfig, currentLicense and currentAPIKeys, since they
+	can change underneath it.
+
+	They are kept together in a snapshot that a reload replaces
+	as a whole, so reading them takes no lock. The snapshot is
+	never changed in place.
+*/
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// held while changing CONFIG, LICENSE and API_KEYS
+	// and applying them
+	configLock sync.Mutex
+
+	running atomic.Value // *runningConfig
+
+	// these are fixed once the server is listening, and
+	// keep their old value on a reload
+	restartOptions = []string{
+		"PORT",
+		"HWM",
+		"CONN_TIMEOUT",
+		"DOMAINS",
+		"ALLOWED_TYPES",
+		"DISPATCH_SHARDS",
+	}
+)
+
+// What the server is running with
+type runningConfig struct {
+	config  Config
+	license License
+	keys    APIKeys
+}
+
+// Makes CONFIG, LICENSE and API_KEYS what the server runs with.
+// Once the server is running, they are only changed, and then
+// applied, under configLock.
+func applyConfig() {
+	running.Store(&runningConfig{config: CONFIG, license: LICENSE, keys: API_KEYS})
+}
+
+// Returns the current config. It is shared, and must
+// not be changed.
+func currentConfig() *Config {
+	return &running.Load().(*runningConfig).config
+}
+
+// Returns the current license keys
+func currentLicense() License {
+	return running.Load().(*runningConfig).license
+}
+
+// Returns the current API keys, or nil if there are none
+func currentAPIKeys() APIKeys {
+	return running.Load().(*runningConfig).keys
+}
+
+// Reads realtime.conf and license.txt again, and applies them
+// to the running server. The overrides (from the command line)
+// are applied on top of the config file. If the config is
+// invalid, nothing changes.
+func reloadConfig(overrides func(conf *Config)) error {
+	c, err := getConf()
+	if err != nil {
+		log.Println("[WARN] Reload: Keeping the current config.", err)
+		return err
+	}
+
+	conf := defaultConfig()
+	if err = readConfig(c, &conf); err != nil {
+		log.Println("[WARN] Reload: Config is invalid. Keeping the current config.", err)
+		return err
+	}
+	if overrides != nil {
+		overrides(&conf)
+	}
+
+	// removing the last license is allowed, and leaves
+	// only localhost licensed
+	license, err := NewLicense()
+	if err == ErrNoLicense {
+		log.Println("[WARN] Reload: No valid license keys were found. Only localhost connections are permitted.")
+	} else if err != nil {
+		log.Println("[WARN] Reload: Keeping the current licenses.", err)
+		license = currentLicense()
+	}
+
+	// a broken keys file keeps the old keys, rather than
+	// opening up the api
+	keys, err := NewAPIKeys(conf)
+	if err != nil {
+		log.Println("[WARN] Reload: Keeping the current API keys.", err)
+		keys = currentAPIKeys()
+	}
+
+	configLock.Lock()
+
+	old, oldLicense, oldKeys := CONFIG, LICENSE, API_KEYS
+
+	oldVal := reflect.ValueOf(old)
+	newVal := reflect.ValueOf(&conf).Elem()
+	for _, name := range restartOptions {
+		if !reflect.DeepEqual(oldVal.FieldByName(name).Interface(), newVal.FieldByName(name).Interface()) {
+			log.Printf("[WARN] Reload: %v can't be changed without a restart. Keeping %v", name, oldVal.FieldByName(name).Interface())
+			newVal.FieldByName(name).Set(oldVal.FieldByName(name))
+		}
+	}
+
+	CONFIG, LICENSE, API_KEYS = conf, license, keys
+	applyConfig()
+
+	configLock.Unlock()
+
+	changes := configChanges(old, conf)
+	changes = append(changes, licenseChanges(oldLicense, license)...)
+	changes = append(changes, apiKeyChanges(oldKeys, keys)...)
+
+	if len(changes) == 0 {
+		log.Println("Reload: Nothing changed")
+	}
+	for _, change := range changes {
+		log.Println("Reload:", change)
+	}
+	checkLicense()
+	logAPIKeyUsage()
+
+	return nil
+}
+
+// Describes each option that differs between two configs
+func configChanges(old, conf Config) []string {
+	var changes []string
+
+	oldVal, newVal := reflect.ValueOf(old), reflect.ValueOf(conf)
+	for i := 0; i < oldVal.NumField(); i++ {
+		name := oldVal.Type().Field(i).Name
+		a, b := oldVal.Field(i).Interface(), newVal.Field(i).Interface()
+
+		switch {
+		case reflect.DeepEqual(a, b):
+		case strings.HasSuffix(name, "SECRET"), strings.HasSuffix(name, "KEY"):
+			// secrets and keys don't go in the logs
+			changes = append(changes, name+" changed")
+		default:
+			changes = append(changes, fmt.Sprintf("%v changed from %v to %v", name, a, b))
+		}
+	}
+	return changes
+}
+
+// Describes the license keys added and removed
+func licenseChanges(old, license License) []string {
+	var changes []string
+
+	keys := make(map[string]bool, len(old))
+	for _, key := range old {
+		keys[key] = true
+	}
+	for _, key := range license {
+		if !keys[key] {
+			changes = append(changes, "License key added: "+key)
+		}
+		delete(keys, key)
+	}
+	for _, key := range old {
+		if keys[key] {
+			changes = append(changes, "License key removed: "+key)
+		}
+	}
+	return changes
+}
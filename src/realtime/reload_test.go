@@ -0,0 +1,152 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, dir, name, content string) {
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Changes the running config, licenses and API keys for the
+// length of the test, as a reload would
+func setTestConfig(tb testing.TB, set func(conf *Config)) {
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	conf, license, keys := CONFIG, LICENSE, API_KEYS
+	tb.Cleanup(func() {
+		configLock.Lock()
+		defer configLock.Unlock()
+
+		CONFIG, LICENSE, API_KEYS = conf, license, keys
+		applyConfig()
+	})
+
+	set(&CONFIG)
+	applyConfig()
+}
+
+// TestReloadConfig
+// Reloads a config and license file, then checks an invalid
+// config is rejected without changing the running config
+func TestReloadConfig(t *testing.T) {
+
+	defer func(root string) { ROOT = root }(ROOT)
+	setTestConfig(t, func(*Config) {})
+
+	ROOT = t.TempDir()
+
+	writeTestFile(t, ROOT, CONF_NAME, `
+[Server]
+debug = False
+
+[Monitor]
+url = http://localhost:9999/monitor
+
+[Messaging]
+history-size = 5
+slow-consumer-policy = drop-newest
+dispatch-shards = 3
+`)
+	writeTestFile(t, ROOT, "license.txt", "abc123\n")
+
+	before := currentConfig()
+
+	if err := reloadConfig(func(conf *Config) { conf.DEBUG = true }); err != nil {
+		t.Fatal("Reload:", err)
+	}
+
+	conf := currentConfig()
+	if conf.HISTORY_SIZE != 5 || conf.SLOW_CONSUMER != POLICY_DROP_NEWEST {
+		t.Fatalf("Expected the reloaded limits but got %+v", conf)
+	}
+	if conf.MONITOR_URL == nil || conf.MONITOR_URL.String() != "http://localhost:9999/monitor" {
+		t.Fatalf("Expected the reloaded monitor url but got %v", conf.MONITOR_URL)
+	}
+	if !conf.DEBUG {
+		t.Fatal("Expected the override to win over the config file")
+	}
+	if conf.DISPATCH_SHARDS != before.DISPATCH_SHARDS {
+		t.Fatalf("Expected dispatch-shards to need a restart, but it changed to %v", conf.DISPATCH_SHARDS)
+	}
+	if license := currentLicense(); len(license) != 1 || license[0] != "abc123" {
+		t.Fatalf("Expected the reloaded license but got %v", license)
+	}
+
+	// the last license can be revoked, leaving only localhost
+	writeTestFile(t, ROOT, "license.txt", "\n")
+	if err := reloadConfig(nil); err != nil {
+		t.Fatal("Reload:", err)
+	}
+	if license := currentLicense(); len(license) != 0 {
+		t.Fatalf("Expected no licenses left but got %v", license)
+	}
+	if before.HISTORY_SIZE == 5 {
+		t.Fatal("Expected a reload to leave the config read before it alone")
+	}
+
+	for _, bad := range []string{
+		"[Messaging]\nslow-consumer-policy = sometimes\n",
+		"[Messaging]\nhistory-size = lots\n",
+		"[Monitor]\nurl = ://nope\n",
+	} {
+		writeTestFile(t, ROOT, CONF_NAME, bad)
+		if err := reloadConfig(nil); err == nil {
+			t.Fatalf("Expected an error reloading %q", bad)
+		}
+		if current := currentConfig(); current.HISTORY_SIZE != 5 || current.SLOW_CONSUMER != POLICY_DROP_NEWEST {
+			t.Fatalf("Expected an invalid config to change nothing, but got %+v", current)
+		}
+	}
+}
+
+// TestReloadOutboundQueue
+// Turns the outbound queues on while a connection is open, and
+// checks it keeps going without one, and is forgotten when it
+// disconnects
+func TestReloadOutboundQueue(t *testing.T) {
+
+	setTestConfig(t, func(conf *Config) { conf.OUTBOUND_QUEUE = 0 })
+
+	server := NewServerHandler(nil)
+	defer server.Shutdown()
+
+	alice := newRecordConn("alice")
+	server.OnRawMessage(alice, []byte(`{"type":"command","identity":"alice","data":{"command":"init","channels":["chat"]}}`))
+
+	setTestConfig(t, func(conf *Config) { conf.OUTBOUND_QUEUE = 10 })
+
+	server.OnRawMessage(alice, []byte(`{"type":"message","identity":"alice","channel":"chat","data":{"text":"hi"}}`))
+	if msg := alice.until(t, func(msg *message) bool { return msg.Type == "message" }); msg.Data["text"] != "hi" {
+		t.Fatalf("Expected the message but got %+v", msg)
+	}
+
+	server.OnDisconnect(alice)
+
+	server.identsLock.RLock()
+	defer server.identsLock.RUnlock()
+	if _, ok := server.idents["alice"]; ok {
+		t.Fatal("Expected alice to be forgotten once disconnected")
+	}
+}
+
+func TestConfigChanges(t *testing.T) {
+	old := defaultConfig()
+	conf := old
+	conf.HISTORY_SIZE = 5
+
+	changes := configChanges(old, conf)
+	if len(changes) != 1 || changes[0] != "HISTORY_SIZE changed from 0 to 5" {
+		t.Fatalf("Expected one change to HISTORY_SIZE but got %v", changes)
+	}
+
+	changes = licenseChanges(License{"a", "b"}, License{"b", "c"})
+	if len(changes) != 2 || changes[0] != "License key added: c" || changes[1] != "License key removed: a" {
+		t.Fatalf("Expected c added and a removed but got %v", changes)
+	}
+}
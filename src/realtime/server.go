@@ -9,60 +9,142 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math/rand"
 	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 	// 3rd party
 	"github.com/justinfx/go-socket.io/socketio"
 )
 
+var (
+	ErrAlreadySubscribed = errors.New("client already subscribed to channel")
+	ErrIdentityOffline   = errors.New("identity is unknown or not connected")
+	ErrShuttingDown      = errors.New("server is shutting down")
+	ErrConnectionLimit   = errors.New("licensed connection limit reached")
+	ErrInvalidExclude    = errors.New("exclude must be connection, identity or none")
+	ErrMalformedCommand  = errors.New("Malformed command message")
+	ErrInitRejected      = errors.New("not subscribed, since another init channel was rejected")
+)
+
+const (
+	// clients are told to wait a random delay of up to this
+	// long before reconnecting after a shutdown, so they
+	// don't all come back at once
+	SHUTDOWN_RECONNECT_SPREAD = 5 * time.Second
+
+	// what a publisher is excluded from receiving of its
+	// own messages
+	EXCLUDE_NONE       = "none"
+	EXCLUDE_CONNECTION = "connection"
+	EXCLUDE_IDENTITY   = "identity"
+)
+
+// A single client connection, on any of the transports
+// the server accepts. A *socketio.Conn is a Conn.
+type Conn interface {
+	Send(data interface{}) error
+	String() string
+}
+
 type ServerHandler struct {
 	Sio *socketio.SocketIO
 
-	subs    map[string][]*Client
 	idents  map[string]*Client
 	clients map[string]*Client
 
-	msgChannel  chan *DispatchReq
-	srvcChannel chan *DispatchReq
-	quit        chan bool
-	quitting    bool
+	// the verified auth claims of each connection that
+	// sent a token, by connection id
+	auth     map[string]*AuthClaims
+	authHook *AuthHook
+
+	// channels are split between the dispatch shards,
+	// each owning their subscribers and history
+	shards []*shard
+
+	// wildcard subscriptions match channels on any shard, so
+	// their subscribers are indexed here rather than in a shard
+	patterns     *PatternTrie
+	patternSubs  map[string][]*Client
+	patternsLock sync.RWMutex
+
+	// every published message is stamped with an id made
+	// from the instance and a server-wide serial, and a
+	// sequence number for its channel
+	instance   string
+	lastSerial uint64
+
+	// requests are only queued to the shards under a read lock,
+	// so Shutdown can't close a queue while it is being sent to
+	quit         chan bool
+	quitting     bool
+	shutdownLock sync.RWMutex
 
 	identsLock, clientsLock sync.RWMutex
 
+	// outbound queues, by connection id. A connection seen
+	// without a queue has a nil entry.
+	queues     map[string]*ConnQueue
+	queuesLock sync.Mutex
+
 	monitorChannel chan *message
+	monitorClosed  bool
+	monitorLock    sync.RWMutex
 }
 
 func NewServerHandler(sio *socketio.SocketIO) (s *ServerHandler) {
 
+	numShards := currentConfig().DISPATCH_SHARDS
+	if numShards <= 0 {
+		numShards = runtime.NumCPU()
+	}
+
 	s = &ServerHandler{
 		Sio: sio,
 
-		subs:    make(map[string][]*Client),
 		idents:  make(map[string]*Client),
 		clients: make(map[string]*Client),
 
-		msgChannel:  make(chan *DispatchReq, 5000),
-		srvcChannel: make(chan *DispatchReq, 500),
-		quit:        make(chan bool, 3),
-		quitting:    false,
+		auth:     make(map[string]*AuthClaims),
+		authHook: NewAuthHook(),
+
+		shards: make([]*shard, numShards),
+
+		patterns:    NewPatternTrie(),
+		patternSubs: make(map[string][]*Client),
+
+		instance: strconv.FormatInt(time.Now().UnixNano(), 36),
+
+		quit:     make(chan bool, numShards+1),
+		quitting: false,
+
+		queues: make(map[string]*ConnQueue),
 
 		monitorChannel: make(chan *message, 500),
 	}
 
-	go s.dispatchServices()
-	go s.dispatchMessages()
-
-	if CONFIG.MONITOR_URL != nil {
-		Debugf("Monitor set to POST to URL %s\n", CONFIG.MONITOR_URL.String())
-		go s.updateMonitor()
+	// the same total message queue as a single dispatcher
+	queueSize := 5000 / numShards
+	for i := range s.shards {
+		s.shards[i] = newShard(s, queueSize)
+		go s.shards[i].run()
+	}
 
-	} else {
-		s.quit <- true
+	// the monitor URL can be set by a reload, so the
+	// monitor runs whether or not there is one yet
+	if url := currentConfig().MONITOR_URL; url != nil {
+		Debugf("Monitor set to POST to URL %s\n", url.String())
 	}
+	go s.updateMonitor()
 
 	return s
 }
@@ -80,7 +162,7 @@ func (s *ServerHandler) OnConnect(c *socketio.Conn) {
 
 // When a client disconnected, remove their Client
 // object reference
-func (s *ServerHandler) OnDisconnect(c *socketio.Conn) {
+func (s *ServerHandler) OnDisconnect(c Conn) {
 
 	defer func() {
 		if r := recover(); r != nil {
@@ -89,49 +171,57 @@ func (s *ServerHandler) OnDisconnect(c *socketio.Conn) {
 		}
 	}()
 
+	// the Client records hold the queued form of the conn
+	c = s.closeOutbound(c)
+
 	s.clientsLock.RLock()
 	client, ok := s.clients[c.String()]
 	s.clientsLock.RUnlock()
 
 	if ok {
 
-		client.lock.RLock()
-		identity := client.Identity
-
-		if len(client.Conns) <= 1 {
-			Debugln("OnDisconnect(): Client is last in group. Unsubscribing", client.Channels)
-
-			msgs := []*message{}
-			for _, val := range client.Channels {
-				msg := NewCommand()
-				msg.Channel = val
-				msg.Data["command"] = "unsubscribe"
-				msg.Identity = identity
-				msgs = append(msgs, msg)
-			}
-			client.lock.RUnlock()
-
-			for _, aMsg := range msgs {
-				req := NewDispatchReq(c, aMsg, true)
-				s.unsubscribeCmd(req)
-				<-req.done
-			}
-
-			if identity != "" {
-				s.identsLock.Lock()
-				delete(s.idents, identity)
-				s.identsLock.Unlock()
-			}
+		// the connection leaves its group under identsLock, so an
+		// init joining the same identity either joins before this
+		// (and the group lives on), or gets a new Client group
+		s.identsLock.Lock()
+		remaining := client.RemoveConn(c)
+		if remaining == 0 && client.Identity != "" && s.idents[client.Identity] == client {
+			delete(s.idents, client.Identity)
+		}
+		s.identsLock.Unlock()
 
-		} else {
+		// the last connection takes every channel of the group
+		// with it. otherwise it lets go of its own subscriptions,
+		// and the group only leaves those no one else holds
+		var channels []string
+		if remaining == 0 {
+			client.lock.RLock()
+			channels = append(channels, client.Channels...)
 			client.lock.RUnlock()
+			Debugln("OnDisconnect(): Client is last in group. Unsubscribing", channels)
+		} else {
+			channels = client.HeldChannels(c)
 		}
 
-		client.RemoveConn(c)
+		msgs := []*message{}
+		for _, val := range channels {
+			msg := NewCommand()
+			msg.Channel = val
+			msg.Data["command"] = "unsubscribe"
+			msg.Identity = client.Identity
+			msgs = append(msgs, msg)
+		}
+
+		// the shards look the Client up by this connection,
+		// so it is only forgotten once they are done
+		for _, aMsg := range msgs {
+			s.unsubscribeCmd(NewDispatchReq(c, aMsg, true))
+		}
 	}
 
 	s.clientsLock.Lock()
 	delete(s.clients, c.String())
+	delete(s.auth, c.String())
 	//	Debugln("OnDisconnect: cleared connection from client list")
 	s.clientsLock.Unlock()
 
@@ -140,7 +230,7 @@ func (s *ServerHandler) OnDisconnect(c *socketio.Conn) {
 // When a raw message comes in from a connected client, we need
 // to parse it and determine what kind it is and how to route it.
 func (s *ServerHandler) OnMessage(c *socketio.Conn, data socketio.Message) {
-	if s.quitting {
+	if s.isQuitting() {
 		return
 	}
 
@@ -149,11 +239,24 @@ func (s *ServerHandler) OnMessage(c *socketio.Conn, data socketio.Message) {
 	if !ok {
 		raw = data.Bytes()
 	}
+
+	s.OnRawMessage(c, raw)
+}
+
+// Handles the raw JSON of a message from a connection on
+// any transport
+func (s *ServerHandler) OnRawMessage(c Conn, raw []byte) {
+	if s.isQuitting() {
+		return
+	}
+
+	c = s.outbound(c)
+
 	Debugln("Raw message from client:", c.String(), string(raw))
 
 	msg, err := NewJsonMessage(raw)
 	if err != nil {
-		Debugln(err, "JSON:", raw, "MSG:", data.Data())
+		Debugln(err, "JSON:", string(raw))
 		return
 	}
 
@@ -177,6 +280,27 @@ func (s *ServerHandler) OnMessage(c *socketio.Conn, data socketio.Message) {
 		return
 	}
 
+	// unsubscribing is always allowed
+	command, _ := msg.Data["command"].(string)
+	if msg.Channel != "" && command != "init" && command != "unsubscribe" && !s.channelAllowed(c, msg.Channel) {
+		errMsg := NewErrorMessage(ErrChannelDenied.Error())
+		errMsg.Channel = msg.Channel
+		Debugln(errMsg)
+		c.Send(errMsg)
+		return
+	}
+
+	if err = s.authorize(c, msg, command); err != nil {
+		errMsg := NewErrorMessage(err.Error())
+		errMsg.Channel = msg.Channel
+		if msg.To != "" {
+			errMsg.Data["to"] = msg.To
+		}
+		Debugln(errMsg)
+		c.Send(errMsg)
+		return
+	}
+
 	switch msg.Type {
 
 	case "command":
@@ -188,11 +312,27 @@ func (s *ServerHandler) OnMessage(c *socketio.Conn, data socketio.Message) {
 		err = s.handleMessage(c, msg)
 
 	default:
-		err = errors.New("Malformed command message")
+		err = ErrMalformedCommand
 	}
 
 	if err != nil {
 		Debugln("Errors during message handling:", err)
+
+		// let the sender know their direct message went nowhere
+		if aclErr, ok := err.(*ACLError); ok {
+			c.Send(aclErr.Reply())
+		} else if err == ErrBroadcastChannel {
+			c.Send(newActionError(ACL_PUBLISH, msg.Channel, err))
+		} else if err == ErrInvalidExclude || err == ErrMalformedCommand {
+			errMsg := NewErrorMessage(err.Error())
+			errMsg.Channel = msg.Channel
+			c.Send(errMsg)
+		} else if msg.To != "" {
+			errMsg := NewErrorMessage(err.Error())
+			errMsg.Channel = msg.Channel
+			errMsg.Data["to"] = msg.To
+			c.Send(errMsg)
+		}
 	}
 
 }
@@ -200,12 +340,17 @@ func (s *ServerHandler) OnMessage(c *socketio.Conn, data socketio.Message) {
 // The message was a 'command' type
 // If its a system command, route it to the handler
 // otherwise, forward it to the other clients as a generic message
-func (s *ServerHandler) handleCommand(c *socketio.Conn, msg *message) (err error) {
+func (s *ServerHandler) handleCommand(c Conn, msg *message) (err error) {
+
+	command, ok := msg.Data["command"].(string)
+	if !ok {
+		return ErrMalformedCommand
+	}
 
-	switch msg.Data["command"].(string) {
+	switch command {
 
 	case "":
-		err = errors.New("Malformed command message")
+		err = ErrMalformedCommand
 
 	case "subscribe":
 		s.subscribeCmd(NewDispatchReq(c, msg, false))
@@ -216,11 +361,18 @@ func (s *ServerHandler) handleCommand(c *socketio.Conn, msg *message) (err error
 	case "init":
 		s.initCmd(NewDispatchReq(c, msg, false))
 
+	case "presence":
+		s.enqueue(s.shardFor(msg.Channel).srvcChannel, NewDispatchReq(c, msg, false))
+
 	default:
 		// not a system command. forward it on
-		if msg.Channel != "" {
+		if isPattern(msg.Channel) {
+			err = ErrPatternPublish
+		} else if msg.Channel != "" || msg.To != "" {
 			Debugln("Forwarding generic command message:", msg.raw)
-			err = s.publish(c, msg)
+			if err = s.checkBroadcast(c, msg); err == nil {
+				err = s.publish(c, msg)
+			}
 		} else {
 			err = errors.New("Generic command message has no channel")
 		}
@@ -232,32 +384,91 @@ func (s *ServerHandler) handleCommand(c *socketio.Conn, msg *message) (err error
 
 // Raw message was a 'message' type. Publish this
 // to clients on the same channel
-func (s *ServerHandler) handleMessage(c *socketio.Conn, msg *message) (err error) {
+func (s *ServerHandler) handleMessage(c Conn, msg *message) (err error) {
 	Debugln("msgHandler():", c, msg.raw)
 
+	if isPattern(msg.Channel) {
+		return ErrPatternPublish
+	}
+
+	if err = s.checkBroadcast(c, msg); err != nil {
+		return err
+	}
+
 	err = s.publish(c, msg)
 
 	return err
 }
 
-func (s *ServerHandler) publish(c *socketio.Conn, msg *message) (err error) {
+// Queue a message for delivery. A message with a To identity
+// is delivered only to the connections of that identity,
+// otherwise it goes to everyone subscribed to its Channel.
+func (s *ServerHandler) publish(c Conn, msg *message) (err error) {
+	return s.publishReq(NewDispatchReq(c, msg, false))
+}
+
+// Queue a publish request. If the message asks for an ack,
+// the request collects the delivery receipt.
+func (s *ServerHandler) publishReq(req *DispatchReq) (err error) {
+	msg := req.Msg
 
-	if msg.Channel == "" || msg.Data == nil || len(msg.Data) == 0 {
+	if (msg.Channel == "" && msg.To == "") || msg.Data == nil || len(msg.Data) == 0 {
 		err = errors.New("msg either has no channel or no data. not publishing")
 		return err
 	}
 
-	req := NewDispatchReq(c, msg, false)
-	s.msgChannel <- req
+	if msg.To != "" && s.identityConns(msg.To) == nil {
+		return ErrIdentityOffline
+	}
 
-	return
+	// publishes from the api have no connection, and
+	// are covered by the api keys instead
+	if req.Conn != nil && msg.Channel != "" {
+		if err = s.checkACL(req.Conn, msg.Identity, ACL_PUBLISH, msg.Channel); err != nil {
+			return err
+		}
+	}
+
+	if !validExclude(msg.Exclude) {
+		return ErrInvalidExclude
+	}
+
+	// the ack and exclude options are between the publisher
+	// and the server, so they aren't passed on to the receivers
+	if msg.Ack {
+		req.Ack = true
+		req.AckIdentities = msg.AckIdentities
+		msg.Ack, msg.AckIdentities = false, false
+	}
+	req.Exclude, msg.Exclude = msg.Exclude, ""
+
+	if msg.To != "" {
+		return s.shardForIdentity(msg.To).publish(req)
+	}
+	return s.shardFor(msg.Channel).publish(req)
+}
+
+// Message ids are the server instance followed by the serial,
+// so they are unique across restarts and ordered within one
+func (s *ServerHandler) messageId(serial uint64) string {
+	return s.instance + "-" + strconv.FormatUint(serial, 10)
+}
+
+// Returns the serial of a message id. ok is false if the
+// id is malformed, or is from another server instance.
+func (s *ServerHandler) parseMessageId(id string) (serial uint64, ok bool) {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 || parts[0] != s.instance {
+		return 0, false
+	}
+	serial, err := strconv.ParseUint(parts[1], 10, 64)
+	return serial, err == nil
 }
 
 func (s *ServerHandler) subscribeCmd(req *DispatchReq) {
 	Debugln("subscribeCmd():", req.Conn, req.Msg.raw)
 
-	s.srvcChannel <- req
-	if req.Wait {
+	if s.enqueue(s.shardFor(req.Msg.Channel).srvcChannel, req) && req.Wait {
 		<-req.done
 	}
 
@@ -267,8 +478,7 @@ func (s *ServerHandler) subscribeCmd(req *DispatchReq) {
 func (s *ServerHandler) unsubscribeCmd(req *DispatchReq) {
 	Debugln("unsubscribeCmd():", req.Conn, req.Msg.raw)
 
-	s.srvcChannel <- req
-	if req.Wait {
+	if s.enqueue(s.shardFor(req.Msg.Channel).srvcChannel, req) && req.Wait {
 		<-req.done
 	}
 
@@ -283,8 +493,17 @@ func (s *ServerHandler) initCmd(req *DispatchReq) {
 	c := req.Conn
 	msg := req.Msg
 
+	claims, err := authenticate(msg)
+	if err != nil {
+		Debugln("initCmd(): Refusing", c, err)
+		errMsg := NewErrorMessage(err.Error())
+		errMsg.Identity = msg.Identity
+		errMsg.Data["command"] = "init"
+		c.Send(errMsg)
+		return
+	}
+
 	s.clientsLock.Lock()
-	defer s.clientsLock.Unlock()
 
 	var (
 		client *Client
@@ -293,10 +512,20 @@ func (s *ServerHandler) initCmd(req *DispatchReq) {
 
 	client, ok = s.clients[c.String()]
 	if ok && client.HasInit() {
+		s.clientsLock.Unlock()
 		Debugln("initCmd(): Client has already init before:", c)
 		return
 	}
 
+	max := currentLicense().MaxConnections(currentConfig().LICENSE_SECRET, time.Now())
+	if max > 0 && len(s.clients) >= max {
+		s.clientsLock.Unlock()
+		log.Printf("[WARN] initCmd(): Refusing %v. %v (%d)", c, ErrConnectionLimit, max)
+		c.Send(NewErrorMessage(ErrConnectionLimit.Error()))
+		closeConn(c)
+		return
+	}
+
 	if msg.Identity != "" {
 		s.identsLock.Lock()
 		client, ok = s.idents[msg.Identity]
@@ -306,7 +535,7 @@ func (s *ServerHandler) initCmd(req *DispatchReq) {
 		} else {
 			client = &Client{
 				Identity: msg.Identity,
-				Conns:    []*socketio.Conn{c},
+				Conns:    []Conn{c},
 			}
 			Debugln("initCmd(): conn is new. creating new Client group:", client)
 		}
@@ -317,200 +546,519 @@ func (s *ServerHandler) initCmd(req *DispatchReq) {
 
 	} else {
 		client = &Client{
-			Conns: []*socketio.Conn{c},
+			Conns: []Conn{c},
 		}
 		s.clients[c.String()] = client
 	}
 
-	/*
-		// TODO: FIXME
-		// Need to properly unbox the []string. 
-		// Right now this crashes
-		channels := msg.Data["channels"]
-		if channels != nil {
-			for _, channel := range channels.([]string) {
-				cmdMsg := NewCommand()
-				cmdMsg.Channel = channel
-				s.subscribeCmd(c, cmdMsg)
+	if claims != nil {
+		s.auth[c.String()] = claims
+	}
+
+	if meta, ok := presenceOption(msg); ok {
+		client.SetPresence("", meta)
+	}
+
+	client.SetInit(true)
+	s.clientsLock.Unlock()
+
+	// batch subscribe to any channels that were passed along
+	// in the init options. they are subscribed all together or
+	// not at all, so whatever would turn one down is checked
+	// before going to the shards
+	channels, rejected := initChannels(msg)
+
+	var allowed []string
+	for _, channel := range channels {
+		if err := s.checkInitChannel(c, msg, channel); err != nil {
+			rejected[channel] = err.Error()
+		} else {
+			allowed = append(allowed, channel)
+		}
+	}
+
+	// the auth hook is asked about them all at once
+	for i, err := range s.authHook.AuthorizeChannels(c, msg.Identity, allowed, AUTH_ACTION_SUBSCRIBE) {
+		if err != nil {
+			rejected[allowed[i]] = err.Error()
+		}
+	}
+
+	if len(channels) > 0 || len(rejected) > 0 {
+		subscribed := []string{}
+
+		attempted := len(rejected) == 0
+		if attempted {
+			errs := s.subscribeBatch(c, msg, channels)
+
+			for i, err := range errs {
+				// another connection of the same identity may
+				// have already subscribed the Client group
+				if err != nil && err != ErrAlreadySubscribed {
+					rejected[channels[i]] = err.Error()
+				}
+			}
+			if len(rejected) == 0 {
+				subscribed = channels
 			}
 		}
-	*/
 
-	client.SetInit(true)
+		// the rest are rejected along with the failures, and
+		// any that did get subscribed are taken back
+		if len(rejected) > 0 {
+			for _, channel := range channels {
+				if _, ok := rejected[channel]; ok {
+					continue
+				}
+				rejected[channel] = ErrInitRejected.Error()
+
+				if attempted {
+					unsub := NewCommand()
+					unsub.Channel = channel
+					unsub.Identity = msg.Identity
+					unsub.Data["command"] = "unsubscribe"
+					s.unsubscribeCmd(NewDispatchReq(c, unsub, true))
+				}
+			}
+		}
+
+		reply := NewCommand()
+		reply.Identity = msg.Identity
+		reply.Data["command"] = "onInit"
+		reply.Data["subscribed"] = subscribed
+		reply.Data["rejected"] = rejected
+		if err := c.Send(reply); err != nil {
+			Debugln("initCmd(): Failed to send onInit reply:", err)
+		}
+	}
 
 	return
 }
 
-func (s *ServerHandler) Shutdown() {
-	s.quitting = true
+// Pulls the list of channels out of an init command.
+// The list can be found in either data.options.channels
+// (the format used by the js client) or data.channels.
+// Returns the valid channel names, and a map of any
+// invalid entries to their error string.
+func initChannels(msg *message) (channels []string, rejected map[string]string) {
+	rejected = make(map[string]string)
+
+	var list interface{}
+	if opts, ok := msg.Data["options"].(map[string]interface{}); ok {
+		list = opts["channels"]
+	}
+	if list == nil {
+		list = msg.Data["channels"]
+	}
 
-	close(s.srvcChannel)
-	close(s.msgChannel)
-	close(s.monitorChannel)
+	switch val := list.(type) {
+	case nil:
+		return
+	case string:
+		list = []interface{}{val}
+	case []interface{}:
+	default:
+		rejected[fmt.Sprint(val)] = "channels must be a list of channel names"
+		return
+	}
 
-	for i := 0; i < 3; i++ {
-		<-s.quit
+	for _, item := range list.([]interface{}) {
+		if name, ok := item.(string); !ok || name == "" {
+			rejected[fmt.Sprint(item)] = "channel name must be a non-empty string"
+		} else {
+			channels = append(channels, name)
+		}
 	}
+	return
 }
 
-// A goroutine that coordinates the internal message
-// routing. Delivers messages to all members of the
-// given channel. Also processes (un)subscription commands
-// by updating an internal map.
-func (s *ServerHandler) dispatchMessages() {
-
-	// standard message channel. a message that will get
-	// published to all other connections currently
-	// subscribed to the same channel
+// Checks an init channel could be subscribed to, before
+// any of them are. The auth hook is left to the caller.
+func (s *ServerHandler) checkInitChannel(c Conn, msg *message, channel string) error {
+	if isPattern(channel) {
+		if err := validatePattern(channel); err != nil {
+			return err
+		}
+	}
+	if !s.channelAllowed(c, channel) {
+		return ErrChannelDenied
+	}
+	return s.checkACL(c, msg.Identity, ACL_SUBSCRIBE, channel)
+}
 
-	var (
-		req     *DispatchReq
-		msg     *message
-		members []*Client
-	)
+// Subscribes the connection to a list of channels. Each shard
+// gets the channels it owns as a single batch, and the shards
+// work through their batches in parallel. Returns one error
+// per channel.
+func (s *ServerHandler) subscribeBatch(c Conn, msg *message, channels []string) []error {
+	batches := make(map[*shard]*DispatchReq)
+	index := make(map[*shard][]int)
+
+	for i, channel := range channels {
+		sh := s.shardFor(channel)
+		batch, ok := batches[sh]
+		if !ok {
+			batch = NewDispatchReq(c, msg, true)
+			batches[sh] = batch
+		}
+		batch.Channels = append(batch.Channels, channel)
+		index[sh] = append(index[sh], i)
+	}
 
-	for req = range s.msgChannel {
+	errs := make([]error, len(channels))
 
-		msg = req.Msg
+	for sh, batch := range batches {
+		if !s.enqueue(sh.srvcChannel, batch) {
+			delete(batches, sh)
+			for _, i := range index[sh] {
+				errs[i] = ErrShuttingDown
+			}
+		}
+	}
 
-		if msg.Channel == "" {
-			req.SetDone()
-			continue
+	for sh, batch := range batches {
+		<-batch.done
+		for j, err := range batch.Errs {
+			errs[index[sh][j]] = err
 		}
+	}
+	return errs
+}
 
-		members = s.subs[msg.Channel]
-		if members == nil || len(members) == 0 {
-			req.SetDone()
-			continue
+// Checks a subscribe, or a publish from a client, with the
+// auth hook
+func (s *ServerHandler) authorize(c Conn, msg *message, command string) error {
+	switch msg.Type {
+	case "message":
+		return s.authHook.Authorize(c, msg, AUTH_ACTION_PUBLISH)
+	case "command":
+		switch command {
+		case "subscribe":
+			return s.authHook.Authorize(c, msg, AUTH_ACTION_SUBSCRIBE)
+		case "", "init", "unsubscribe", "presence":
+		default:
+			// a generic command is forwarded like a message
+			return s.authHook.Authorize(c, msg, AUTH_ACTION_PUBLISH)
 		}
+	}
+	return nil
+}
 
-		//Debugln("startDispatcher(): Sending message w/ data - ", msg.Data)
+// Returns true if the connection may use the channel. Only
+// connections with auth claims are restricted.
+func (s *ServerHandler) channelAllowed(c Conn, channel string) bool {
+	s.clientsLock.RLock()
+	claims := s.auth[c.String()]
+	s.clientsLock.RUnlock()
 
-		for i, _ := range members {
-			for j := 0; j < len(members[i].Conns); {
-				if err := members[i].Conns[j].Send(msg); err != nil {
-					members[i].Conns = append(members[i].Conns[:j], members[i].Conns[j+1:]...)
-					//s.subs[msg.Channel] = members
-				} else {
-					j++
-				}
-			}
+	return claims == nil || claims.Allows(channel)
+}
+
+// Queues a request on a shard. Returns false, without
+// queueing, once the server is shutting down.
+func (s *ServerHandler) enqueue(queue chan *DispatchReq, req *DispatchReq) bool {
+	s.shutdownLock.RLock()
+	defer s.shutdownLock.RUnlock()
+
+	if s.quitting {
+		return false
+	}
+	queue <- req
+	return true
+}
+
+func (s *ServerHandler) isQuitting() bool {
+	s.shutdownLock.RLock()
+	defer s.shutdownLock.RUnlock()
+
+	return s.quitting
+}
+
+// Blocks until every message that has been published
+// so far has been dispatched, on every shard.
+func (s *ServerHandler) flushMessages() {
+	s.flushShards(nil)
+}
+
+// Sends a barrier through every shard, and waits for them all
+// to reach it. Returns false if the timeout closes first.
+func (s *ServerHandler) flushShards(timeout <-chan struct{}) bool {
+	reqs := make([]*DispatchReq, len(s.shards))
+	for i, sh := range s.shards {
+		reqs[i] = NewDispatchReq(nil, NewMessage(), true)
+		select {
+		case sh.msgChannel <- reqs[i]:
+		case <-timeout:
+			return false
 		}
-		req.SetDone()
 	}
-	s.quit <- true
+	for _, req := range reqs {
+		select {
+		case <-req.done:
+		case <-timeout:
+			return false
+		}
+	}
+	return true
 }
 
-func (s *ServerHandler) dispatchServices() {
-	// Service messages include subscribe/unsubscribe
-	// commands and are checked on a seperate channel
-	// from messages so that their queue doest get 
-	// flooded
+// Shuts the server down gracefully. New messages are refused,
+// the messages already queued are dispatched, then every client
+// is sent an onShutdown command and disconnected once its queue
+// has drained. Whatever is left after the shutdown timeout
+// is dropped.
+func (s *ServerHandler) Shutdown() {
+	s.shutdownLock.Lock()
+	if s.quitting {
+		s.shutdownLock.Unlock()
+		return
+	}
+	s.quitting = true
+	s.shutdownLock.Unlock()
 
-	var (
-		req        *DispatchReq
-		msg        *message
-		reply      *message
-		client     *Client
-		clientTest *Client
-		members    []*Client
-		ok         bool
-	)
+	// every step waits on the same deadline
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(currentConfig().SHUTDOWN_TIMEOUT)*time.Second)
+	defer cancel()
+	timeout := ctx.Done()
 
-Dispatch:
-	for req = range s.srvcChannel {
+	if !s.flushShards(timeout) {
+		log.Println("[WARN] Shutdown(): Timed out dispatching queued messages")
+	}
 
-		msg = req.Msg
+	s.disconnectAll(timeout)
 
-		if msg.Channel == "" {
-			req.SetDone()
-			continue
-		}
+	// nothing is sent to the shards or the monitor after this
+	s.shutdownLock.Lock()
+	for _, sh := range s.shards {
+		close(sh.srvcChannel)
+		close(sh.msgChannel)
+	}
+	s.shutdownLock.Unlock()
 
-		members, ok = s.subs[msg.Channel]
-		if !ok {
-			members = []*Client{}
+	s.monitorLock.Lock()
+	close(s.monitorChannel)
+	s.monitorClosed = true
+	s.monitorLock.Unlock()
+
+	for i := 0; i < len(s.shards)+1; i++ {
+		select {
+		case <-s.quit:
+		case <-timeout:
+			log.Println("[WARN] Shutdown(): Timed out waiting for the dispatchers and monitor")
+			return
 		}
+	}
+}
 
-		switch msg.Data["command"].(string) {
+// Sends every connection an onShutdown command, with a hint
+// of how long to wait before reconnecting, and closes it once
+// everything queued for it has been sent
+func (s *ServerHandler) disconnectAll(timeout <-chan struct{}) {
+	s.clientsLock.RLock()
+	conns := make([]Conn, 0, len(s.clients))
+	for id, client := range s.clients {
+		client.lock.RLock()
+		for _, c := range client.Conns {
+			if c.String() == id {
+				conns = append(conns, c)
+			}
+		}
+		client.lock.RUnlock()
+	}
+	s.clientsLock.RUnlock()
 
-		case "subscribe":
+	spread := int64(SHUTDOWN_RECONNECT_SPREAD / time.Millisecond)
 
-			s.clientsLock.RLock()
-			client = s.clients[req.Conn.String()]
-			s.clientsLock.RUnlock()
+	for _, c := range conns {
+		msg := NewCommand()
+		msg.Data["command"] = "onShutdown"
+		msg.Data["reconnect"] = rand.Int63n(spread)
+		if err := c.Send(msg); err != nil {
+			Debugln("disconnectAll(): Failed to send onShutdown:", err)
+		}
+		closeConn(c)
+	}
 
-			for _, clientTest = range members {
-				if clientTest == client {
-					err := errors.New("client already subscribed to channel")
-					Debugln(err)
-					req.SetDone()
-					continue Dispatch
-				}
-			}
-			members = append(members, client)
-			s.subs[msg.Channel] = members
-
-			reply = NewCommand()
-			reply.Channel = msg.Channel
-			reply.Identity = msg.Identity
-			reply.Data["command"] = "onSubscribe"
-			reply.Data["options"] = msg.Data["options"]
-			reply.Data["count"] = len(members)
-
-			s.publish(req.Conn, reply)
-			s.monitorChannel <- reply
-
-			client.AddChannel(msg.Channel)
-
-			Debugf("dispatchServices(): subscribed %v => \"%v\"", client, msg.Channel)
-
-		case "unsubscribe":
-
-			ok = false
-
-			s.clientsLock.RLock()
-			client = s.clients[req.Conn.String()]
-			s.clientsLock.RUnlock()
-
-			for i := 0; i < len(members); {
-				clientTest = members[i]
-				//Debugf("dispatchServices(): %v == %v ? %v", clientTest, client, clientTest==client)
-				if clientTest == client {
-					members = append(members[:i], members[i+1:]...)
-					s.subs[msg.Channel] = members
-					ok = true
-					Debugf("dispatchServices(): unsubscribing %v from %v", req.Conn, msg.Channel)
-					break
-				} else {
-					i++
-				}
+	for _, c := range conns {
+		if q, ok := c.(*ConnQueue); ok {
+			select {
+			case <-q.done:
+			case <-timeout:
+				log.Println("[WARN] Shutdown(): Timed out draining connection queues")
+				return
 			}
+		}
+	}
+}
 
-			if ok {
-				reply = NewCommand()
-				reply.Identity = msg.Identity
-				reply.Channel = msg.Channel
-				reply.Data["command"] = "onUnsubscribe"
-				reply.Data["options"] = msg.Data["options"]
-				reply.Data["count"] = len(s.subs[msg.Channel])
+// Closes a connection once anything queued for it has been sent
+func closeConn(c Conn) {
+	if q, ok := c.(*ConnQueue); ok {
+		q.Drain()
+	} else if closer, ok := c.(io.Closer); ok {
+		closer.Close()
+	}
+}
 
-				s.publish(req.Conn, reply)
-				s.monitorChannel <- reply
+// Builds an onJoin or onLeave event for an identity
+func newPresenceEvent(command, channel string, client *Client, count int) *message {
+	event := NewCommand()
+	event.Channel = channel
+	event.Identity = client.Identity
+	event.Data["command"] = command
+	event.Data["presence"] = client.PresenceFor(channel)
+	event.Data["count"] = count
+	return event
+}
 
-				client.RemoveChannel(msg.Channel)
+// Pulls the client-supplied presence metadata out of
+// the options of an init or subscribe command
+func presenceOption(msg *message) (meta interface{}, ok bool) {
+	opts, isMap := msg.Data["options"].(map[string]interface{})
+	if !isMap {
+		return nil, false
+	}
+	meta, ok = opts["presence"]
+	return meta, ok
+}
 
-			} else {
-				err := errors.New("client was not subscribed to channel")
-				Debugln(err)
-				req.SetDone()
-				continue
-			}
+// Pulls the exclude option out of a subscribe command. It
+// sets what a subscriber is excluded from receiving of its
+// own messages to the channel.
+func excludeOption(msg *message) (exclude string, ok bool) {
+	opts, isMap := msg.Data["options"].(map[string]interface{})
+	if !isMap {
+		return "", false
+	}
+	exclude, ok = opts["exclude"].(string)
+	return exclude, ok
+}
+
+func validExclude(exclude string) bool {
+	switch exclude {
+	case "", EXCLUDE_NONE, EXCLUDE_CONNECTION, EXCLUDE_IDENTITY:
+		return true
+	}
+	return false
+}
+
+// Returns a copy of the connections for an identity, or
+// nil if the identity has no connections
+func (s *ServerHandler) identityConns(identity string) []Conn {
+	s.identsLock.RLock()
+	client, ok := s.idents[identity]
+	s.identsLock.RUnlock()
+
+	if !ok {
+		return nil
+	}
+
+	client.lock.RLock()
+	defer client.lock.RUnlock()
+
+	if len(client.Conns) == 0 {
+		return nil
+	}
+	conns := make([]Conn, len(client.Conns))
+	copy(conns, client.Conns)
+	return conns
+}
+
+// Pulls the replay options out of a subscribe command.
+// options.history is the number of recent messages wanted,
+// and options.since is the id of the last message seen.
+func historyOptions(msg *message) (n int, since string, ok bool) {
+	opts, isMap := msg.Data["options"].(map[string]interface{})
+	if !isMap {
+		return
+	}
+	if val, isStr := opts["since"].(string); isStr && val != "" {
+		return 0, val, true
+	}
+	if val, isNum := opts["history"].(float64); isNum && val > 0 {
+		return int(val), "", true
+	}
+	return
+}
+
+// Returns the queued form of a connection, starting its
+// outbound queue the first time the connection is seen. A
+// connection keeps the form it was first seen in, so the
+// Client records holding it stay valid across reloads.
+func (s *ServerHandler) outbound(c Conn) Conn {
+	if _, ok := c.(*ConnQueue); ok {
+		return c
+	}
+
+	s.queuesLock.Lock()
+	defer s.queuesLock.Unlock()
+
+	// a reload only changes the queues of new connections
+	q, ok := s.queues[c.String()]
+	if !ok {
+		if conf := currentConfig(); conf.OUTBOUND_QUEUE > 0 {
+			q = NewConnQueue(c, conf.OUTBOUND_QUEUE, conf.SLOW_CONSUMER)
+			q.onDropped = s.reportDropped
 		}
+		s.queues[c.String()] = q
+	}
+	if q == nil {
+		return c
+	}
+	return q
+}
 
-		req.SetDone()
+// Stops the outbound queue of a connection that has gone away.
+// Returns the queued form of the connection, if it had one.
+func (s *ServerHandler) closeOutbound(c Conn) Conn {
+	s.queuesLock.Lock()
+	q, ok := s.queues[c.String()]
+	delete(s.queues, c.String())
+	s.queuesLock.Unlock()
+
+	if !ok || q == nil {
+		return c
+	}
+	q.Close()
+	return q
+}
+
+// Lets the monitor know a slow consumer has had messages
+// dropped from its queue
+func (s *ServerHandler) reportDropped(q *ConnQueue, n uint64) {
+	Debugf("reportDropped(): %v dropped %d messages", q, n)
+
+	msg := NewCommand()
+	msg.Data["command"] = "onDropped"
+	msg.Data["connection"] = q.String()
+	msg.Data["dropped"] = n
+	msg.Data["total"] = q.Dropped()
+	msg.Data["policy"] = q.policy
+
+	s.clientsLock.RLock()
+	if client, ok := s.clients[q.String()]; ok {
+		msg.Identity = client.Identity
+	}
+	s.clientsLock.RUnlock()
+
+	s.notifyMonitor(msg)
+}
+
+// Queue a message for the monitor URL. Nothing reads the
+// monitor queue if no monitor is configured.
+func (s *ServerHandler) notifyMonitor(msg *message) {
+	if currentConfig().MONITOR_URL == nil {
+		return
+	}
+
+	// the shards notify the monitor, so this can't wait
+	// on the shutdownLock
+	s.monitorLock.RLock()
+	defer s.monitorLock.RUnlock()
+
+	if !s.monitorClosed {
+		s.monitorChannel <- msg
 	}
-	s.quit <- true
 }
 
 func (s *ServerHandler) updateMonitor() {
@@ -525,6 +1073,12 @@ func (s *ServerHandler) updateMonitor() {
 
 	for msg = range s.monitorChannel {
 
+		monitorURL := currentConfig().MONITOR_URL
+		if monitorURL == nil {
+			// removed by a reload
+			continue
+		}
+
 		if json_msg, err = json.MarshalIndent(msg, "", "\t"); err != nil {
 			Debugf("updateMonitor(): Failed to parse []*message to json: %s\n", err.Error())
 
@@ -535,15 +1089,16 @@ func (s *ServerHandler) updateMonitor() {
 			buf.Reset()
 			buf.Write(json_msg)
 
-			resp, err = http.Post(CONFIG.MONITOR_URL.String(), "application/json", &buf)
+			resp, err = http.Post(monitorURL.String(), "application/json", &buf)
 			if err != nil {
 				log.Println("[WARN] updateMonitor(): POST request failed w/ error: ", err)
 
-			} else if resp.StatusCode != http.StatusOK {
-				log.Println("[WARN] updateMonitor(): POST request failed w/ status code", resp.StatusCode)
+			} else {
+				if resp.StatusCode != http.StatusOK {
+					log.Println("[WARN] updateMonitor(): POST request failed w/ status code", resp.StatusCode)
+				}
+				resp.Body.Close()
 			}
-
-			resp.Body.Close()
 		}
 	}
 
@@ -555,24 +1110,42 @@ func (s *ServerHandler) updateMonitor() {
 //
 type Client struct {
 	Identity string
-	Conns    []*socketio.Conn
+	Conns    []Conn
 	Channels []string
 	hasInit  bool
 	lock     sync.RWMutex
+
+	// presence metadata, set at init and optionally
+	// overridden per channel at subscribe
+	presence        interface{}
+	channelPresence map[string]interface{}
+
+	// exclude options of the subscriptions, by channel
+	// or pattern
+	excludes map[string]string
+
+	// the connections holding each subscription. the group
+	// only leaves a channel when the last of them does
+	holders map[string][]Conn
 }
 
 func (c *Client) String() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
 	return fmt.Sprintf("Client{Identity: %v, #Conn: %d, Conn: %v}", c.Identity, len(c.Conns), c.Conns)
 }
 
-func (c *Client) AddConn(conn *socketio.Conn) {
+func (c *Client) AddConn(conn Conn) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
 	c.Conns = append(c.Conns, conn)
 }
 
-func (c *Client) RemoveConn(conn *socketio.Conn) {
+// Removes the connection from the group. Returns the
+// number of connections left.
+func (c *Client) RemoveConn(conn Conn) int {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
@@ -583,19 +1156,55 @@ func (c *Client) RemoveConn(conn *socketio.Conn) {
 			i++
 		}
 	}
+	return len(c.Conns)
 }
 
-func (c *Client) AddChannel(channel string) {
+// Send the data to each connection in the group. Returns the
+// number of connections it was sent to. A connection that fails
+// is left for OnDisconnect to remove, and one that dropped the
+// data to its slow consumer policy isn't counted.
+func (c *Client) Send(data interface{}) (sent int) {
+	return c.SendExcept(data, nil)
+}
+
+// Send the data to each connection in the group but one
+func (c *Client) SendExcept(data interface{}, except Conn) (sent int) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	for _, conn := range c.Conns {
+		if conn == except {
+			continue
+		}
+		if err := conn.Send(data); err == nil {
+			sent++
+		}
+	}
+	return sent
+}
+
+// Adds the channel to the group's list. Returns false if the
+// group has no connections left, since OnDisconnect will
+// already have taken the list to unsubscribe.
+func (c *Client) AddChannel(channel string) bool {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
+	if len(c.Conns) == 0 {
+		return false
+	}
 	c.Channels = append(c.Channels, channel)
+	return true
 }
 
 func (c *Client) RemoveChannel(channel string) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
+	delete(c.channelPresence, channel)
+	delete(c.excludes, channel)
+	delete(c.holders, channel)
+
 	for i := 0; i < len(c.Channels); {
 		if c.Channels[i] == channel {
 			c.Channels = append(c.Channels[:i], c.Channels[i+1:]...)
@@ -605,6 +1214,132 @@ func (c *Client) RemoveChannel(channel string) {
 	}
 }
 
+// Records the connection as holding the group's subscription
+// to the channel. A connection that has already left the group,
+// with its subscribe still queued, can't hold anything.
+func (c *Client) HoldChannel(channel string, conn Conn) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	member := false
+	for _, other := range c.Conns {
+		member = member || other == conn
+	}
+	if !member {
+		return
+	}
+
+	for _, held := range c.holders[channel] {
+		if held == conn {
+			return
+		}
+	}
+	if c.holders == nil {
+		c.holders = make(map[string][]Conn)
+	}
+	c.holders[channel] = append(c.holders[channel], conn)
+}
+
+// Lets go of the connection's hold on the subscription to the
+// channel. Returns whether it held it, and how many connections
+// still do.
+func (c *Client) ReleaseChannel(channel string, conn Conn) (held bool, left int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	holders := c.holders[channel]
+	for i := 0; i < len(holders); i++ {
+		if holders[i] == conn {
+			holders = append(holders[:i:i], holders[i+1:]...)
+			held = true
+			break
+		}
+	}
+	if len(holders) == 0 {
+		delete(c.holders, channel)
+	} else {
+		c.holders[channel] = holders
+	}
+	return held, len(holders)
+}
+
+// Returns the channels the connection holds a subscription to
+func (c *Client) HeldChannels(conn Conn) []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	var channels []string
+	for _, channel := range c.Channels {
+		for _, held := range c.holders[channel] {
+			if held == conn {
+				channels = append(channels, channel)
+				break
+			}
+		}
+	}
+	return channels
+}
+
+// Set the presence metadata for a channel, or the
+// default for all channels if channel is empty
+func (c *Client) SetPresence(channel string, meta interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if channel == "" {
+		c.presence = meta
+		return
+	}
+	if c.channelPresence == nil {
+		c.channelPresence = make(map[string]interface{})
+	}
+	c.channelPresence[channel] = meta
+}
+
+func (c *Client) PresenceFor(channel string) interface{} {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if meta, ok := c.channelPresence[channel]; ok {
+		return meta
+	}
+	return c.presence
+}
+
+// Set the exclude option of the subscription to a channel
+func (c *Client) SetExclude(channel, exclude string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.excludes == nil {
+		c.excludes = make(map[string]string)
+	}
+	c.excludes[channel] = exclude
+}
+
+// Returns the exclude option of the subscription that takes
+// in the channel. A subscription to the channel itself wins,
+// then the most specific of the wildcard subscriptions.
+func (c *Client) ExcludeFor(channel string) string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if exclude, ok := c.excludes[channel]; ok {
+		return exclude
+	}
+
+	var best, found string
+	for pattern, exclude := range c.excludes {
+		if !isPattern(pattern) || !patternCovers(pattern, channel) {
+			continue
+		}
+		if best == "" || moreSpecific(pattern, best) {
+			best, found = pattern, exclude
+		}
+	}
+	return found
+}
+
 func (c *Client) HasInit() bool {
 	c.lock.RLock()
 	init := c.hasInit
@@ -621,11 +1356,28 @@ func (c *Client) SetInit(val bool) {
 type DispatchReq struct {
 	Msg  *message
 	Wait bool
-	Conn *socketio.Conn
+	Conn Conn
+	Err  error
+
+	// An Ack request counts the connections (and optionally
+	// identities) the message was delivered to
+	Ack           bool
+	AckIdentities bool
+	Delivered     int
+	Identities    []string
+
+	// The publisher's exclude option
+	Exclude string
+
+	// A batch (init) request carries a list of channels
+	// and gets back one error per channel
+	Channels []string
+	Errs     []error
+
 	done chan bool
 }
 
-func NewDispatchReq(c *socketio.Conn, m *message, wait bool) *DispatchReq {
+func NewDispatchReq(c Conn, m *message, wait bool) *DispatchReq {
 
 	req := &DispatchReq{
 		Msg:  m,
@@ -633,8 +1385,10 @@ func NewDispatchReq(c *socketio.Conn, m *message, wait bool) *DispatchReq {
 		Wait: wait,
 	}
 
+	// buffered, so a shard never waits on whoever asked,
+	// and can go on to its next request
 	if wait {
-		req.done = make(chan bool)
+		req.done = make(chan bool, 1)
 	}
 
 	return req
@@ -0,0 +1,249 @@
+package main
+
+/*
+	Server-Sent Events
+
+	A read-only subscription endpoint that streams channel
+	messages as text/event-stream, for consumers that can't
+	use websockets. The stream is registered with the
+	ServerHandler as a normal subscriber.
+
+	GET /api/subscribe?channel=a&channel=b&identity=x
+
+	With auth configured, the JWT is given as a token parameter
+	or an "Authorization: Bearer" header.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// comment lines are sent this often to keep
+	// proxies from closing an idle stream
+	SSE_KEEPALIVE = 15 * time.Second
+)
+
+var (
+	sseConnCount uint64
+
+	ErrStreamClosed = errors.New("event stream is closed")
+)
+
+// An event stream client connection
+type SSEConn struct {
+	writer  http.ResponseWriter
+	flusher http.Flusher
+	id      string
+	closed  bool
+
+	// closed along with the conn, to end the stream
+	done chan struct{}
+
+	// events are written from the dispatchers and
+	// the keepalive loop
+	lock sync.Mutex
+}
+
+func NewSSEConn(w http.ResponseWriter, f http.Flusher) *SSEConn {
+	return &SSEConn{
+		writer:  w,
+		flusher: f,
+		id:      fmt.Sprintf("sse-%d", atomic.AddUint64(&sseConnCount, 1)),
+		done:    make(chan struct{}),
+	}
+}
+
+func (c *SSEConn) String() string {
+	return c.id
+}
+
+// Send the data as a single event. Messages with an id set
+// it as the event id, so a client can resume with Last-Event-ID.
+func (c *SSEConn) Send(data interface{}) error {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	id := ""
+	if msg, ok := data.(*message); ok {
+		id = msg.Id
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return ErrStreamClosed
+	}
+
+	if id != "" {
+		fmt.Fprintf(c.writer, "id: %s\n", id)
+	}
+	if _, err = fmt.Fprintf(c.writer, "data: %s\n\n", buf); err != nil {
+		return err
+	}
+	c.flusher.Flush()
+	return nil
+}
+
+func (c *SSEConn) keepAlive() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return ErrStreamClosed
+	}
+	if _, err := fmt.Fprint(c.writer, ": keepalive\n\n"); err != nil {
+		return err
+	}
+	c.flusher.Flush()
+	return nil
+}
+
+// Once the handler returns, the ResponseWriter can't be used.
+// Closing the conn from the server side ends the stream.
+func (c *SSEConn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		close(c.done)
+	}
+	return nil
+}
+
+// The handler function for streaming channel messages as
+// Server-Sent Events. Any number of channel parameters can be
+// given, along with an optional identity. If the client sends
+// a Last-Event-ID header, each channel replays its history
+// from that message.
+func HandleGetAPISubscribe(writer http.ResponseWriter, req *http.Request) {
+
+	if req.Method != "GET" {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+
+	} else if !currentLicense().CheckHttpRequest(req) {
+		writer.WriteHeader(http.StatusUnauthorized)
+		writer.Write([]byte("Error: Domain name origin is not licensed for this server\n"))
+		return
+	}
+
+	query := req.URL.Query()
+	channels := query["channel"]
+	if len(channels) == 0 {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Error: At least one channel parameter is required\n"))
+		return
+	}
+
+	initMsg := NewCommand()
+	initMsg.Identity = query.Get("identity")
+	initMsg.Data["command"] = "init"
+	initMsg.Data["token"] = requestToken(req)
+
+	claims, err := authenticate(initMsg)
+	if err != nil {
+		writer.WriteHeader(http.StatusUnauthorized)
+		writer.Write([]byte("Error: " + err.Error() + "\n"))
+		return
+	}
+	var roles []string
+	if claims != nil {
+		roles = claims.Roles
+	}
+	for _, channel := range channels {
+		if claims != nil && !claims.Allows(channel) {
+			writer.WriteHeader(http.StatusForbidden)
+			writer.Write([]byte("Error: " + ErrChannelDenied.Error() + ": " + channel + "\n"))
+			return
+		}
+		if !aclAllows(currentConfig().ACL_RULES, initMsg.Identity, roles, ACL_SUBSCRIBE, channel) {
+			writer.WriteHeader(http.StatusForbidden)
+			writer.Write([]byte("Error: " + (&ACLError{ACL_SUBSCRIBE, channel}).Error() + "\n"))
+			return
+		}
+	}
+
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		writer.WriteHeader(http.StatusInternalServerError)
+		writer.Write([]byte("Error: Streaming is not supported\n"))
+		return
+	}
+
+	conn := NewSSEConn(writer, flusher)
+	defer conn.Close()
+
+	// the auth hook has its say before anything is streamed
+	for i, err := range SERVER.authHook.AuthorizeChannels(conn, initMsg.Identity, channels, AUTH_ACTION_SUBSCRIBE) {
+		if err != nil {
+			if err == ErrAuthUnavailable {
+				writer.WriteHeader(http.StatusServiceUnavailable)
+			} else {
+				writer.WriteHeader(http.StatusForbidden)
+			}
+			writer.Write([]byte("Error: " + err.Error() + ": " + channels[i] + "\n"))
+			return
+		}
+	}
+
+	header := writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	writer.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	Debugln("api/HandleGetAPISubscribe: New event stream", conn, channels)
+
+	// the server sends to the stream through its outbound queue
+	out := SERVER.outbound(conn)
+
+	// deferred, so a panic still cleans up the stream's Client
+	defer SERVER.OnDisconnect(conn)
+
+	SERVER.initCmd(NewDispatchReq(out, initMsg, false))
+
+	lastId := req.Header.Get("Last-Event-ID")
+	for _, channel := range channels {
+		sub := NewCommand()
+		sub.Channel = channel
+		sub.Identity = initMsg.Identity
+		sub.Data["command"] = "subscribe"
+		if lastId != "" {
+			sub.Data["options"] = map[string]interface{}{"since": lastId}
+		}
+		SERVER.subscribeCmd(NewDispatchReq(out, sub, true))
+	}
+
+	ticker := time.NewTicker(SSE_KEEPALIVE)
+	defer ticker.Stop()
+
+Stream:
+	for {
+		select {
+		case <-req.Context().Done():
+			break Stream
+		case <-conn.done:
+			break Stream
+		case <-ticker.C:
+			if err := conn.keepAlive(); err != nil {
+				break Stream
+			}
+		}
+	}
+
+	Debugln("api/HandleGetAPISubscribe: Event stream closed", conn)
+
+	conn.Close()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func publishTestMsg(t *testing.T, channel, val string) *message {
+	msg := NewMessage()
+	msg.Channel = channel
+	msg.Data["msg"] = val
+	if err := SERVER.publish(nil, msg); err != nil {
+		t.Fatal("publish:", err)
+	}
+	SERVER.flushMessages()
+	return msg
+}
+
+// Reads the next event from the stream, skipping keepalives
+func readEvent(t *testing.T, reader *bufio.Reader) (id string, msg *message) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal("Read event:", err)
+		}
+		line = strings.TrimRight(line, "\n")
+
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = line[4:]
+		case strings.HasPrefix(line, "data: "):
+			if msg, err = NewJsonMessage([]byte(line[6:])); err != nil {
+				t.Fatalf("Event data was not valid JSON: %v, error: %v", line, err)
+			}
+		case line == "" && msg != nil:
+			return id, msg
+		}
+	}
+}
+
+// TestSSESubscribe
+// Resumes an event stream with Last-Event-ID and checks the
+// missed message is replayed before live messages
+func TestSSESubscribe(t *testing.T) {
+
+	setTestConfig(t, func(conf *Config) { conf.HISTORY_SIZE = 10 })
+
+	SERVER = NewServerHandler(nil)
+	defer SERVER.Shutdown()
+
+	srv := httptest.NewServer(http.HandlerFunc(HandleGetAPISubscribe))
+	defer srv.Close()
+
+	first := publishTestMsg(t, "news", "first")
+	publishTestMsg(t, "news", "second")
+
+	url := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+	req, _ := http.NewRequest("GET", url+"/api/subscribe?channel=news&identity=TEST1", nil)
+	req.Header.Set("Last-Event-ID", first.Id)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		resp.Body.Close()
+		waitForDisconnects(t)
+	}()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected text/event-stream but got %v", ct)
+	}
+
+	reader := bufio.NewReader(resp.Body)
+
+	_, msg := readEvent(t, reader)
+	if msg.Data["command"] != "onSubscribe" || msg.Data["count"].(float64) != 1 {
+		t.Fatalf("Expected onSubscribe with a count of 1 but got %v", msg)
+	}
+
+	_, msg = readEvent(t, reader)
+	if msg.Data["command"] != "onJoin" {
+		t.Fatalf("Expected onJoin but got %v", msg)
+	}
+
+	id, msg := readEvent(t, reader)
+	if msg.Data["msg"] != "second" || id != msg.Id {
+		t.Fatalf("Expected the second message to be replayed with its id but got %v (id: %v)", msg, id)
+	}
+
+	_, msg = readEvent(t, reader)
+	if msg.Data["command"] != "onHistory" || msg.Data["truncated"] != false {
+		t.Fatalf("Expected a complete onHistory but got %v", msg)
+	}
+
+	publishTestMsg(t, "news", "live")
+	if _, msg = readEvent(t, reader); msg.Data["msg"] != "live" {
+		t.Fatalf("Expected the live message but got %v", msg)
+	}
+}
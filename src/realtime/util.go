@@ -1,29 +1,15 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
-	"crypto/sha1"
 	"errors"
 	"fmt"
 	"github.com/kless/goconfig/config"
-	"net"
-	"net/http"
 	"net/url"
-	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
-var (
-	// License checking is sha1("domain.com"+PADDING)
-	PADDING = []byte("Rk8ohYJQBXopu82XmVTFsAgG3r4f")
-)
-
-const (
-	LOCALHOST = `localhost`
-)
-
 // Looks for a realtime.conf file in either the current
 // directory, an etc/ subdir, or an etc/ directory one up
 // from the current directory
@@ -50,130 +36,165 @@ func getConf() (*config.Config, error) {
 
 }
 
-type License []string
-
-// Looks for a license.txt file in either the current
-// directory, an etc subdir, or an etc directory one up
-// from the current directory
-// Returns a new License object, populated with the parsed
-// license keys
-func NewLicense() (license License, err error) {
-	lic := "license.txt"
-
-	p1 := filepath.Join(ROOT, lic)
-
-	parent, _ := filepath.Split(ROOT)
-	p2 := filepath.Join(parent, "etc", lic)
-
-	p3 := filepath.Join(ROOT, "etc", lic)
-
-	var (
-		reader *bufio.Reader
-		line   []byte
-		prefix bool
-		fh     *os.File
-		buffer bytes.Buffer
-	)
-
-	for _, p := range []string{p1, p2, p3} {
-		if fileExists(p) {
-			fh, err = os.Open(p)
-			if err != nil {
-				continue
-			}
-
-			reader = bufio.NewReaderSize(fh, 50)
-
-			buffer.Reset()
+// Reads the options from the config file into conf.
+// Returns an error for the first invalid value found.
+func readConfig(c *config.Config, conf *Config) error {
+
+	// a number that doesn't parse would otherwise be
+	// silently left at its default
+	numbers := [][2]string{
+		{"Server", "websocket-port"},
+		{"Server", "reconnect-timeout"},
+		{"Server", "shutdown-timeout"},
+		{"Messaging", "message-cache-limit"},
+		{"Messaging", "history-size"},
+		{"Messaging", "history-max-age"},
+		{"Messaging", "outbound-queue-size"},
+		{"Messaging", "dispatch-shards"},
+		{"Auth", "cache-ttl"},
+		{"Auth", "timeout"},
+	}
+	for _, opt := range numbers {
+		if _, e := c.Int(opt[0], opt[1]); e != nil && c.HasOption(opt[0], opt[1]) {
+			return fmt.Errorf("%v option \"%v\" is not a valid number", opt[0], opt[1])
+		}
+	}
 
-			for {
-				line, prefix, err = reader.ReadLine()
-				if err != nil {
-					err = nil
-					break
-				}
-				if len(line) == 0 || bytes.IndexAny(line, "#/;") > -1 {
-					continue
-				}
+	if v, e := c.Bool("Server", "debug"); e == nil {
+		conf.DEBUG = v
+	}
+	if v, e := c.Int("Server", "websocket-port"); e == nil {
+		conf.PORT = v
+	}
+	if v, e := c.Int("Server", "reconnect-timeout"); e == nil {
+		conf.CONN_TIMEOUT = v
+	}
+	if v, e := c.Int("Server", "shutdown-timeout"); e == nil {
+		conf.SHUTDOWN_TIMEOUT = v
+	}
 
-				buffer.WriteString(string(line))
-				if prefix {
-					continue
-				}
+	if v, e := c.String("Monitor", "url"); e == nil {
+		conf.MONITOR_URL, e = url.Parse(v)
+		if e != nil {
+			return fmt.Errorf("Monitor URL \"%v\" is not valid", v)
+		}
+	}
 
-				license = append(license, string(buffer.Bytes()))
-				buffer.Reset()
+	if v, e := c.Int("Messaging", "message-cache-limit"); e == nil {
+		conf.HWM = v
+	}
+	if v, e := c.Int("Messaging", "history-size"); e == nil {
+		conf.HISTORY_SIZE = v
+	}
+	if v, e := c.Int("Messaging", "history-max-age"); e == nil {
+		conf.HISTORY_MAX_AGE = v
+	}
+	if v, e := c.Bool("Messaging", "legacy-timestamps"); e == nil {
+		conf.LEGACY_TIMESTAMPS = v
+	}
+	if v, e := c.Int("Messaging", "outbound-queue-size"); e == nil {
+		conf.OUTBOUND_QUEUE = v
+	}
+	if v, e := c.String("Messaging", "slow-consumer-policy"); e == nil && v != "" {
+		if !validPolicy(v) {
+			return fmt.Errorf("Slow consumer policy \"%v\" is not valid", v)
+		}
+		conf.SLOW_CONSUMER = v
+	}
+	if v, e := c.Int("Messaging", "dispatch-shards"); e == nil {
+		conf.DISPATCH_SHARDS = v
+	}
+	if v, e := c.String("Messaging", "broadcast-channels"); e == nil {
+		conf.BROADCAST_CHANNELS = splitList(v)
+		for _, pattern := range conf.BROADCAST_CHANNELS {
+			if e = validatePattern(pattern); e != nil {
+				return fmt.Errorf("Messaging broadcast-channels: %v", e)
 			}
 		}
 	}
-	if len(license) == 0 {
-		err = errors.New("Unable to find/read any valid licenses")
+	if v, e := c.String("Messaging", "broadcast-publishers"); e == nil {
+		conf.BROADCAST_PUBLISHERS = splitList(v)
 	}
-	return license, err
 
-}
+	if v, e := c.String("License", "secret"); e == nil && v != "" {
+		conf.LICENSE_SECRET = v
+	}
 
-// Matches a given license string against the licenses
-// in the current configuration, and return true if its valid.
-func (l License) IsValid(lic string) bool {
-	buf := new(bytes.Buffer)
-	for _, val := range l {
-		buf.WriteString("License test failures: " + val + " != " + lic + "\n")
-		if val == lic {
-			return true
+	if v, e := c.String("Auth", "jwt-secret"); e == nil && v != "" {
+		conf.AUTH_SECRET = v
+	}
+	if v, e := c.String("Auth", "jwt-public-key"); e == nil && v != "" {
+		if !filepath.IsAbs(v) {
+			v = filepath.Join(ROOT, v)
+		}
+		if conf.AUTH_PUBLIC_KEY, e = loadPublicKey(v); e != nil {
+			return fmt.Errorf("Auth jwt-public-key: %v", e)
 		}
 	}
-	Debugln(buf.String())
-	return false
-}
-
-func (l License) CheckHttpRequest(req *http.Request) bool {
-	var (
-		url_         *url.URL
-		err          error
-		origin, host string
-	)
-
-	origin = req.Header.Get("Origin")
-	if origin == "" {
-		origin = req.Header.Get("Sec-Websocket-Origin")
+	if v, e := c.Bool("Auth", "require-auth"); e == nil {
+		conf.AUTH_REQUIRED = v
+	} else if c.HasOption("Auth", "require-auth") {
+		return errors.New("Auth option \"require-auth\" is not a valid boolean")
+	}
+	if conf.AUTH_REQUIRED && !authEnabled(conf) {
+		return errors.New("Auth require-auth needs a jwt-secret or jwt-public-key")
+	}
+	if v, e := c.String("Auth", "url"); e == nil && v != "" {
+		conf.AUTH_URL, e = url.Parse(v)
+		if e != nil || conf.AUTH_URL.Host == "" {
+			return fmt.Errorf("Auth URL \"%v\" is not valid", v)
+		}
+	}
+	if v, e := c.Int("Auth", "cache-ttl"); e == nil {
+		conf.AUTH_CACHE_TTL = v
+	}
+	if v, e := c.Int("Auth", "timeout"); e == nil {
+		conf.AUTH_TIMEOUT = v
+	}
+	if v, e := c.Bool("Auth", "fail-open"); e == nil {
+		conf.AUTH_FAIL_OPEN = v
 	}
 
-	if origin != "" {
-		url_, err = url.Parse(origin)
+	if v, e := c.String("API", "keys-file"); e == nil {
+		conf.API_KEYS_FILE = v
+	}
 
-		if err == nil && url_.Host != "" {
-			origin = strings.SplitN(url_.Host, ":", 2)[0]
+	if c.HasSection("ACL") {
+		names, _ := c.Options("ACL")
+		sort.Strings(names)
 
-			if strings.Count(origin, ".") > 1 {
-				if ok := net.ParseIP(origin); ok == nil {
-					parts := strings.Split(origin, ".")
-					origin = strings.Join(parts[len(parts)-2:], ".")
-				}
+		conf.ACL_RULES = nil
+		for _, name := range names {
+			v, _ := c.String("ACL", name)
+			rule, e := parseACLRule(name, v)
+			if e != nil {
+				return e
 			}
+			conf.ACL_RULES = append(conf.ACL_RULES, rule)
 		}
 	}
 
-	host = strings.SplitN(req.Host, ":", 2)[0]
-
-	// localhost connections to a local server are always allowed
-	if host == LOCALHOST && (origin == "" || origin == LOCALHOST) {
-		return true
-	} else if origin == "" {
-		origin = host
+	if v, e := c.String("Server", "allowed-types"); e == nil && v != "" {
+		types := strings.Split(v, ",")
+		for i, s := range types {
+			types[i] = strings.TrimSpace(s)
+		}
+		if len(types) > 0 {
+			conf.ALLOWED_TYPES = types
+		}
 	}
 
-	if len(l) == 0 {
-		return false
-	}
+	return nil
+}
 
-	hash := sha1.New()
-	hash.Write([]byte(origin))
-	hash.Write(PADDING)
-	passed := l.IsValid(fmt.Sprintf("%x", hash.Sum(nil)))
-	if !passed {
-		Debugf("host: %v, origin: %v\n", host, origin)
+// Splits a comma separated option into its trimmed,
+// non-empty items
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
-	return passed
-
+	return items
 }
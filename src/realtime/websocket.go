@@ -0,0 +1,100 @@
+package main
+
+/*
+	Websocket
+
+	A plain RFC 6455 websocket transport, for clients that
+	don't speak socket.io. Each text frame carries a single
+	JSON message, in the same format as the socket.io
+	transports, and connections are handled by the same
+	ServerHandler so both share channels and identities.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	// 3rd party
+	"golang.org/x/net/websocket"
+)
+
+var (
+	wsConnCount uint64
+)
+
+// A websocket client connection
+type WebsocketConn struct {
+	ws *websocket.Conn
+	id string
+
+	// frames can be sent from several dispatchers at once
+	lock sync.Mutex
+}
+
+func NewWebsocketConn(ws *websocket.Conn) *WebsocketConn {
+	return &WebsocketConn{
+		ws: ws,
+		id: fmt.Sprintf("ws-%d", atomic.AddUint64(&wsConnCount, 1)),
+	}
+}
+
+func (c *WebsocketConn) String() string {
+	return c.id
+}
+
+// Send the data as a single JSON text frame
+func (c *WebsocketConn) Send(data interface{}) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return websocket.JSON.Send(c.ws, data)
+}
+
+func (c *WebsocketConn) Close() error {
+	return c.ws.Close()
+}
+
+// Returns the handler for the raw websocket endpoint.
+// Connections must pass the same license check as socket.io
+func NewWebsocketHandler() http.Handler {
+	return websocket.Server{
+		Handshake: func(config *websocket.Config, req *http.Request) error {
+			if !currentLicense().CheckHttpRequest(req) {
+				return errors.New("Domain name origin is not licensed for this server")
+			}
+			return nil
+		},
+		Handler: websocket.Handler(HandleWebsocket),
+	}
+}
+
+// Reads frames from the websocket until it closes, passing
+// each one to the ServerHandler as a message
+func HandleWebsocket(ws *websocket.Conn) {
+	conn := NewWebsocketConn(ws)
+
+	// deferred, so a panic handling a message still
+	// cleans up the connection's Client
+	defer func() {
+		SERVER.OnDisconnect(conn)
+		conn.Close()
+	}()
+
+	Debugln("HandleWebsocket(): New connection", conn)
+
+	var (
+		raw []byte
+		err error
+	)
+
+	for {
+		if err = websocket.Message.Receive(ws, &raw); err != nil {
+			Debugln("HandleWebsocket(): Connection closed", conn, err)
+			break
+		}
+		SERVER.OnRawMessage(conn, raw)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func dialWebsocket(t *testing.T, srv *httptest.Server) *websocket.Conn {
+	// license checks only let through localhost
+	addr := strings.Replace(srv.URL, "http://127.0.0.1", "ws://localhost", 1)
+	ws, err := websocket.Dial(addr+"/api/ws", "", "http://localhost/")
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	return ws
+}
+
+// Closes the client side of the websocket, and waits for the
+// server to be done disconnecting it
+func closeWebsocket(t *testing.T, ws *websocket.Conn) {
+	ws.Close()
+	waitForDisconnects(t)
+}
+
+// Waits for the server to forget every client, so that
+// a test doesn't shut it down under a disconnecting handler
+func waitForDisconnects(t *testing.T) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		SERVER.clientsLock.RLock()
+		n := len(SERVER.clients)
+		SERVER.clientsLock.RUnlock()
+
+		if n == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected every client to disconnect, but %d are left", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func receiveMessage(t *testing.T, ws *websocket.Conn) *message {
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var raw []byte
+	if err := websocket.Message.Receive(ws, &raw); err != nil {
+		t.Fatal("Receive:", err)
+	}
+	msg, err := NewJsonMessage(raw)
+	if err != nil {
+		t.Fatalf("Client received a message that was not valid JSON: %v, error: %v", string(raw), err)
+	}
+	return msg
+}
+
+// TestWebsocket
+// Connects a plain websocket client, then subscribes and
+// publishes through the same ServerHandler as socket.io
+func TestWebsocket(t *testing.T) {
+
+	SERVER = NewServerHandler(nil)
+	defer SERVER.Shutdown()
+
+	srv := httptest.NewServer(NewWebsocketHandler())
+	defer srv.Close()
+
+	ws := dialWebsocket(t, srv)
+	defer closeWebsocket(t, ws)
+
+	if err := websocket.Message.Send(ws, `{"type":"command","identity":"TEST1",`+
+		`"data":{"command":"init","options":{"channels":["chat"]}}}`); err != nil {
+		t.Fatal("Send init:", err)
+	}
+
+	reply := receiveMessage(t, ws)
+	if reply.Data["command"] != "onSubscribe" || reply.Channel != "chat" {
+		t.Fatalf("Expected onSubscribe for chat but got %v", reply)
+	}
+
+	reply = receiveMessage(t, ws)
+	if reply.Data["command"] != "onJoin" || reply.Identity != IDENT {
+		t.Fatalf("Expected onJoin for %v but got %v", IDENT, reply)
+	}
+
+	reply = receiveMessage(t, ws)
+	if reply.Data["command"] != "onInit" {
+		t.Fatalf("Expected onInit but got %v", reply)
+	}
+
+	if err := websocket.Message.Send(ws, newMsgStr("hello")); err != nil {
+		t.Fatal("Send message:", err)
+	}
+
+	reply = receiveMessage(t, ws)
+	if reply.Data["msg"] != "hello" || reply.Identity != IDENT {
+		t.Fatalf("Expected the published message back but got %v", reply)
+	}
+
+	for _, raw := range []string{
+		`{"type":"command","channel":"chat","data":{"command":5}}`,
+		`{"type":"command","channel":"chat","data":{}}`,
+	} {
+		if err := websocket.Message.Send(ws, raw); err != nil {
+			t.Fatal("Send command:", err)
+		}
+		if reply = receiveMessage(t, ws); reply.Error != ErrMalformedCommand.Error() {
+			t.Fatalf("Expected an error for %v but got %v", raw, reply)
+		}
+	}
+}
+
+// TestShutdown
+// Shuts the server down with a message still to be delivered,
+// and checks the client gets it, then an onShutdown command,
+// before being disconnected
+func TestShutdown(t *testing.T) {
+
+	SERVER = NewServerHandler(nil)
+	defer SERVER.Shutdown()
+
+	srv := httptest.NewServer(NewWebsocketHandler())
+	defer srv.Close()
+
+	ws := dialWebsocket(t, srv)
+	defer closeWebsocket(t, ws)
+
+	if err := websocket.Message.Send(ws, `{"type":"command","identity":"TEST1",`+
+		`"data":{"command":"init","options":{"channels":["chat"]}}}`); err != nil {
+		t.Fatal("Send init:", err)
+	}
+	for reply := receiveMessage(t, ws); reply.Data["command"] != "onInit"; {
+		reply = receiveMessage(t, ws)
+	}
+
+	msg := NewMessage()
+	msg.Channel = "chat"
+	msg.Data["msg"] = "last"
+	if err := SERVER.publish(nil, msg); err != nil {
+		t.Fatal("publish:", err)
+	}
+
+	SERVER.Shutdown()
+
+	reply := receiveMessage(t, ws)
+	if reply.Data["msg"] != "last" {
+		t.Fatalf("Expected the queued message before shutting down but got %v", reply)
+	}
+
+	reply = receiveMessage(t, ws)
+	if reply.Data["command"] != "onShutdown" {
+		t.Fatalf("Expected onShutdown but got %v", reply)
+	}
+	if delay, ok := reply.Data["reconnect"].(float64); !ok || delay < 0 {
+		t.Fatalf("Expected a reconnect delay but got %v", reply.Data["reconnect"])
+	}
+
+	var raw []byte
+	if err := websocket.Message.Receive(ws, &raw); err == nil {
+		t.Fatalf("Expected the connection to be closed but got %v", string(raw))
+	}
+
+	msg = NewMessage()
+	msg.Channel = "chat"
+	msg.Data["msg"] = "too late"
+	if err := SERVER.publish(nil, msg); err != ErrShuttingDown {
+		t.Fatalf("Expected %v publishing after shutdown but got %v", ErrShuttingDown, err)
+	}
+}
@@ -53,7 +53,7 @@
 			// the above connect() calls this event
 	        this.socket.addEvent('connect', function() {
 	            
-	            // send init
+	            // send init, which subscribes to the channels too
 	            this.send({
 	                type: "command",
 	                identity: self.identity,
@@ -65,11 +65,6 @@
 	                }
 	            });
 	            
-	            // after init, we can subscribe
-	            if(self.options.subscription) {
-	            	self.subscribe(self.options.subscription);
-	            }
-	            
 	            // if we passed a function
 	            if(options.onConnect) {
 	            	options.onConnect();
@@ -87,8 +82,8 @@
 				// if we have an error, throw it
 	            if(json.error) self.debug(json.error,json);
 	            
-	            // the date comes in in a stupid format
-	            json.timestamp = self.formatDate(json.timestamp);
+	            // prefer the epoch milliseconds, which every browser can parse
+	            json.timestamp = self.formatDate(json.timestamp_ms || json.timestamp);
 				
 				if(typeof self.channels[json.channel] != "undefined") {
 
@@ -175,7 +170,7 @@
 	    },
 	    formatDate: function(timestamp) {
 	        if (this.options.dateFormat) {
-	            var d = new Date(Date(timestamp));
+	            var d = new Date(timestamp);
 	            return d.format(this.options.dateFormat);
 	        } else {
 	            return timestamp;